@@ -0,0 +1,276 @@
+package westack
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+const defaultVerificationTtl = time.Hour
+
+// verificationTokenType is the "type" claim of email verification tokens. GetBearer rejects every token with a type
+// other than "access", so they only work at GET /<users>/verify-mail
+const verificationTokenType = "verify_email"
+
+// verificationTtl returns the lifetime of email verification tokens, set in seconds with verifyEmail.ttl in config.json
+func (app *WeStack) verificationTtl() time.Duration {
+	if seconds := app.viper.GetInt64("verifyEmail.ttl"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultVerificationTtl
+}
+
+// signVerificationToken signs a token that only allows to mark email as the verified email of the user userId
+func (app *WeStack) signVerificationToken(userId primitive.ObjectID, email string) (string, error) {
+	return app.signToken(jwt.MapClaims{
+		"type":   verificationTokenType,
+		"userId": userId.Hex(),
+		"email":  email,
+		"exp":    time.Now().Add(app.verificationTtl()).Unix(),
+	})
+}
+
+// verifyMailUrl returns the url of GET /<users>/verify-mail under publicUrl in config.json. It panics without publicUrl
+func (app *WeStack) verifyMailUrl(loadedModel *model.Model) string {
+	publicUrl := app.publicUrl()
+	if publicUrl == "" {
+		panic("publicUrl is required in config.json to send the email verification links")
+	}
+	return publicUrl + loadedModel.BaseUrl + "/verify-mail"
+}
+
+/*
+sendEmailVerification signs a verification token for the current email of the user, and passes it to the
+sendVerificationEmail handler in the Data of its context. Without handler, the verify-email template is sent with the
+mail datasource, if there is one:
+  - email
+  - token: valid for verifyEmail.ttl seconds
+  - link: verifyMailUrl() with the token in the query
+*/
+func (app *WeStack) sendEmailVerification(loadedModel *model.Model, user *model.Instance, ctx *model.EventContext) error {
+	email := user.GetString("email")
+	token, err := app.signVerificationToken(user.Id.(primitive.ObjectID), email)
+	if err != nil {
+		return err
+	}
+	notifierContext := &model.EventContext{
+		BaseContext: ctx,
+		Ctx:         ctx.Ctx,
+		Instance:    user,
+		Data: &wst.M{
+			"email": email,
+			"token": token,
+			"link":  app.verifyMailUrl(loadedModel) + "?token=" + url.QueryEscape(token),
+		},
+	}
+	if loadedModel.HasHandler("sendVerificationEmail") || app.mailDatasource() == nil {
+		return loadedModel.GetHandler("sendVerificationEmail")(notifierContext)
+	}
+	return app.sendVerificationMail(notifierContext)
+}
+
+// verifyEmail marks the email of a verification token as verified, if it is still the email of the user
+func (app *WeStack) verifyEmail(loadedModel *model.Model, rawToken string) error {
+	invalidTokenErr := wst.CreateError(fiber.ErrUnauthorized, "INVALID_VERIFICATION_TOKEN", fiber.Map{"message": "invalid or expired verification token"}, "Error")
+
+	claims, err := app.parseToken(rawToken)
+	if err != nil || claims["type"] != verificationTokenType {
+		return invalidTokenErr
+	}
+	userIdHex, _ := claims["userId"].(string)
+	userId, err := primitive.ObjectIDFromHex(userIdHex)
+	if err != nil {
+		return invalidTokenErr
+	}
+	user, err := loadedModel.FindById(userId, nil, systemContext())
+	if err != nil {
+		return err
+	}
+	if user == nil || user.GetString("email") != claims["email"] {
+		return invalidTokenErr
+	}
+	_, err = user.UpdateAttributes(wst.M{"emailVerified": true}, &model.EventContext{BaseContext: systemContext(), SkipFieldProtection: true})
+	return err
+}
+
+// protectedUserFields returns the fields of User models that Create, or UpdateAttributes if not new, cannot write
+// without SkipFieldProtection
+func protectedUserFields(isNewInstance bool) []string {
+	if isNewInstance {
+		return []string{"emailVerified", mfaField}
+	}
+	return []string{"email", "emailVerified", "password", mfaField}
+}
+
+// rejectProtectedFields returns an error if data writes one of fields, or a path inside it, directly or with an update
+// operator like $set, $unset or $rename
+func rejectProtectedFields(data wst.M, fields []string) error {
+	for key, value := range data {
+		keys := []string{key}
+		if strings.HasPrefix(key, "$") {
+			var operatorData map[string]interface{}
+			switch value.(type) {
+			case wst.M:
+				operatorData = value.(wst.M)
+				break
+			case map[string]interface{}:
+				operatorData = value.(map[string]interface{})
+				break
+			default:
+				return wst.CreateError(fiber.ErrBadRequest, "INVALID_UPDATE_OPERATOR", fiber.Map{"message": fmt.Sprintf("invalid value for %v", key)}, "ValidationError")
+			}
+			keys = []string{}
+			for operatorKey, operatorValue := range operatorData {
+				keys = append(keys, operatorKey)
+				// $rename writes the field named by the value
+				if target, ok := operatorValue.(string); ok && key == "$rename" {
+					keys = append(keys, target)
+				}
+			}
+		}
+		for _, candidate := range keys {
+			for _, field := range fields {
+				if candidate == field || strings.HasPrefix(candidate, field+".") {
+					return wst.CreateError(fiber.ErrBadRequest, "PROTECTED_FIELD", fiber.Map{"message": fmt.Sprintf("%v cannot be changed with this method", field)}, "ValidationError")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// currentUser returns the user of the bearer of the request, and sets the bearer in the context
+func (app *WeStack) currentUser(loadedModel *model.Model, ctx *model.EventContext) (*model.Instance, error) {
+	err, token := ctx.GetBearer(loadedModel)
+	if err != nil {
+		return nil, err
+	}
+	if token.User == nil || token.User.Id == nil {
+		return nil, wst.CreateError(fiber.ErrUnauthorized, "UNAUTHORIZED", fiber.Map{"message": "a session token is required"}, "Error")
+	}
+	ctx.Bearer = token
+	user, err := loadedModel.FindById(token.User.Id, nil, systemContext())
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, wst.CreateError(fiber.ErrUnauthorized, "UNAUTHORIZED", fiber.Map{"message": "user not found"}, "Error")
+	}
+	return user, nil
+}
+
+func checkPassword(user *model.Instance, password string) error {
+	savedPassword := user.GetString("password")
+	if savedPassword == "" || bcrypt.CompareHashAndPassword([]byte(savedPassword), []byte(password)) != nil {
+		return wst.CreateError(fiber.ErrUnauthorized, "INVALID_PASSWORD", fiber.Map{"message": "invalid password"}, "Error")
+	}
+	return nil
+}
+
+// changePassword sets the new password of the current user, and revokes the tokens of every other session
+func (app *WeStack) changePassword(loadedModel *model.Model, ctx *model.EventContext) error {
+	oldPassword, _ := (*ctx.Data)["oldPassword"].(string)
+	newPassword, _ := (*ctx.Data)["newPassword"].(string)
+	if strings.TrimSpace(newPassword) == "" {
+		return wst.CreateError(fiber.ErrBadRequest, "PASSWORD_BLANK", fiber.Map{"message": "Invalid password"}, "ValidationError")
+	}
+	user, err := app.currentUser(loadedModel, ctx)
+	if err != nil {
+		return err
+	}
+	err = checkPassword(user, oldPassword)
+	if err != nil {
+		return err
+	}
+	// The password is hashed by the before_save handler of User models
+	_, err = user.UpdateAttributes(wst.M{"password": newPassword}, &model.EventContext{BaseContext: systemContext(), SkipFieldProtection: true})
+	if err != nil {
+		return err
+	}
+	sessionId, _ := ctx.Bearer.Claims["sid"].(string)
+	return app.revokeTokens(wst.Where{"userId": user.Id, "sessionId": wst.M{"$ne": sessionId}})
+}
+
+/*
+changeEmail sets the new email of the current user after checking the password. The email is marked as not verified,
+and a verification email is sent to the new address, as in POST /<users>/verify-mail
+*/
+func (app *WeStack) changeEmail(loadedModel *model.Model, ctx *model.EventContext) error {
+	email, _ := (*ctx.Data)["email"].(string)
+	password, _ := (*ctx.Data)["password"].(string)
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return wst.CreateError(fiber.ErrBadRequest, "EMAIL_PRESENCE", fiber.Map{"message": "Invalid email", "codes": wst.M{"email": []string{"presence"}}}, "ValidationError")
+	}
+	user, err := app.currentUser(loadedModel, ctx)
+	if err != nil {
+		return err
+	}
+	err = checkPassword(user, password)
+	if err != nil {
+		return err
+	}
+	// The uniqueness of the new email is checked by the before save handler
+	updated, err := user.UpdateAttributes(wst.M{"email": email, "emailVerified": false}, &model.EventContext{BaseContext: systemContext(), SkipFieldProtection: true})
+	if err != nil {
+		return err
+	}
+
+	return app.sendEmailVerification(loadedModel, updated, ctx)
+}
+
+/*
+deleteSelf deletes the current user, applying the "onDelete" option of its relations, and removes its tokens,
+identities and role mappings
+*/
+func (app *WeStack) deleteSelf(loadedModel *model.Model, ctx *model.EventContext) error {
+	user, err := app.currentUser(loadedModel, ctx)
+	if err != nil {
+		return err
+	}
+	userId := user.Id.(primitive.ObjectID)
+	_, err = loadedModel.DeleteById(userId, ctx)
+	if err != nil {
+		return err
+	}
+	err = app.revokeTokens(wst.Where{"userId": userId})
+	if err != nil {
+		return err
+	}
+	if app.userIdentityModel != nil {
+		err = deleteAll(app.userIdentityModel, wst.Where{"userId": userId})
+		if err != nil {
+			return err
+		}
+	}
+	if app.roleMappingModel != nil {
+		err = deleteAll(app.roleMappingModel, wst.Where{"principalType": "USER", "$or": []wst.M{{"principalId": userId.Hex()}, {"principalId": userId}}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteAll(loadedModel *model.Model, where wst.Where) error {
+	instances, err := loadedModel.FindMany(&wst.Filter{Where: &where}, &model.EventContext{BaseContext: systemContext(), DisableTypeConversions: true})
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		_, err = loadedModel.DeleteById(instance.Id, systemContext())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
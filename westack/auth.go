@@ -0,0 +1,316 @@
+package westack
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+const (
+	defaultTokenTtl        = 14 * 24 * time.Hour
+	defaultRefreshTokenTtl = 60 * 24 * time.Hour
+)
+
+// tokenTtl returns the lifetime of access tokens, set in seconds with jwt.ttl in config.json
+func (app *WeStack) tokenTtl() time.Duration {
+	if seconds := app.viper.GetInt64("jwt.ttl"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultTokenTtl
+}
+
+// refreshTokenTtl returns the lifetime of refresh tokens, set in seconds with jwt.refreshTtl in config.json
+func (app *WeStack) refreshTokenTtl() time.Duration {
+	if seconds := app.viper.GetInt64("jwt.refreshTtl"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultRefreshTokenTtl
+}
+
+// signToken signs the claims with the current key of jwt.keys, or with JWT_SECRET if there are no keys
+func (app *WeStack) signToken(claims jwt.MapClaims) (string, error) {
+	if app.jwtKeys != nil && app.jwtKeys.signingKey != nil {
+		signingKey := app.jwtKeys.signingKey
+		token := jwt.NewWithClaims(signingKey.method, claims)
+		token.Header["kid"] = signingKey.kid
+		return token.SignedString(signingKey.privateKey)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(app.jwtSecretKey)
+}
+
+// parseToken verifies a token issued by this app. Tokens of external identity providers are rejected
+func (app *WeStack) parseToken(rawToken string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(rawToken, app.jwtKeyFunc)
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || app.isExternalToken(token) {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return claims, nil
+}
+
+func systemContext() *model.EventContext {
+	return &model.EventContext{
+		Bearer: &model.BearerToken{
+			User:  &model.BearerUser{System: true},
+			Roles: []model.BearerRole{},
+		},
+	}
+}
+
+// findUserRoles returns the names of the roles of the user, always including USER
+func (app *WeStack) findUserRoles(userId primitive.ObjectID) ([]string, error) {
+	roleNames := []string{"USER"}
+	if app.roleMappingModel == nil {
+		return roleNames, nil
+	}
+	roleContext := &model.EventContext{
+		BaseContext:            systemContext(),
+		DisableTypeConversions: true,
+	}
+	roleEntries, err := app.roleMappingModel.FindMany(&wst.Filter{Where: &wst.Where{
+		"principalType": "USER",
+		"$or": []wst.M{
+			{
+				"principalId": userId.Hex(),
+			},
+			{
+				"principalId": userId,
+			},
+		},
+	}, Include: &wst.Include{{Relation: "role"}}}, roleContext)
+	if err != nil {
+		return nil, err
+	}
+	for _, roleEntry := range roleEntries {
+		role := roleEntry.GetOne("role")
+		roleNames = append(roleNames, role.ToJSON()["name"].(string))
+	}
+	return roleNames, nil
+}
+
+// persistTokens reports whether access tokens are stored, so they can be revoked before they expire. It is enabled
+// with jwt.persistTokens in config.json
+func (app *WeStack) persistTokens() bool {
+	return app.viper.GetBool("jwt.persistTokens")
+}
+
+/*
+issueTokens signs a new access token for the user, and a refresh token that is stored so it can be used only once.
+Both belong to the session sessionId, or to a new session if it is empty. The access token has the realm of the user,
+if it has one, and the "mfa" claim when the session was opened with a second factor. The response contains:
+  - id: the access token, valid for jwt.ttl seconds
+  - userId
+  - ttl: the lifetime of the access token in seconds
+  - refreshToken: valid for jwt.refreshTtl seconds at POST /<users>/refresh
+*/
+func (app *WeStack) issueTokens(user *model.Instance, roleNames []string, sessionId string, mfa bool, ctx *model.EventContext) (fiber.Map, error) {
+	userId := user.Id.(primitive.ObjectID)
+	if sessionId == "" {
+		sessionId = uuid.New().String()
+	}
+	sessionData := wst.M{"userId": userId, "sessionId": sessionId, "mfa": mfa}
+	if ctx != nil && ctx.Ctx != nil {
+		sessionData["userAgent"] = ctx.Ctx.Get(fiber.HeaderUserAgent)
+		sessionData["ip"] = ctx.Ctx.IP()
+	}
+
+	now := time.Now()
+	ttl := app.tokenTtl()
+	accessExpiresAt := now.Add(ttl)
+	accessJti := uuid.New().String()
+	accessClaims := jwt.MapClaims{
+		"userId":  userId.Hex(),
+		"created": now.UnixMilli(),
+		"ttl":     ttl.Milliseconds(),
+		"exp":     accessExpiresAt.Unix(),
+		"roles":   roleNames,
+		"jti":     accessJti,
+		"sid":     sessionId,
+	}
+	if realm := user.GetString(realmField); realm != "" {
+		accessClaims[realmField] = realm
+	}
+	if mfa {
+		accessClaims["mfa"] = true
+	}
+	accessToken, err := app.signToken(accessClaims)
+	if err != nil {
+		return nil, err
+	}
+	if app.persistTokens() {
+		err = app.storeToken(sessionData, "access", accessJti, accessExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	refreshExpiresAt := now.Add(app.refreshTokenTtl())
+	refreshJti := uuid.New().String()
+	refreshToken, err := app.signToken(jwt.MapClaims{
+		"userId": userId.Hex(),
+		"type":   "refresh",
+		"jti":    refreshJti,
+		"exp":    refreshExpiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = app.storeToken(sessionData, "refresh", refreshJti, refreshExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return fiber.Map{"id": accessToken, "userId": userId.Hex(), "ttl": int64(ttl.Seconds()), "refreshToken": refreshToken}, nil
+}
+
+func (app *WeStack) storeToken(sessionData wst.M, tokenType string, jti string, expiresAt time.Time) error {
+	data := wst.CopyMap(sessionData)
+	data["type"] = tokenType
+	data["jti"] = jti
+	data["expiresAt"] = expiresAt
+	_, err := app.accessTokenModel.Create(data, systemContext())
+	return err
+}
+
+/*
+refreshTokens exchanges a refresh token for a new pair of tokens in the same session. Every refresh token is valid only
+once: using one that was already exchanged revokes every token of the user, as it was probably leaked.
+*/
+func (app *WeStack) refreshTokens(loadedModel *model.Model, rawRefreshToken string, ctx *model.EventContext) (fiber.Map, error) {
+	invalidTokenErr := wst.CreateError(fiber.ErrUnauthorized, "INVALID_REFRESH_TOKEN", fiber.Map{"message": "invalid or expired refresh token"}, "Error")
+
+	claims, err := app.parseToken(rawRefreshToken)
+	if err != nil || claims["type"] != "refresh" {
+		return nil, invalidTokenErr
+	}
+	userIdHex, _ := claims["userId"].(string)
+	userId, err := primitive.ObjectIDFromHex(userIdHex)
+	if err != nil {
+		return nil, invalidTokenErr
+	}
+
+	storedToken, err := app.claimStoredToken(claims["jti"], "refresh")
+	if err != nil {
+		return nil, err
+	}
+	if storedToken == nil {
+		err = app.revokeTokens(wst.Where{"userId": userId})
+		if err != nil {
+			return nil, err
+		}
+		return nil, invalidTokenErr
+	}
+	sessionId, _ := (*storedToken)["sessionId"].(string)
+	mfa, _ := (*storedToken)["mfa"].(bool)
+	// The previous access tokens of the session are replaced by the new one
+	err = app.revokeTokens(wst.Where{"sessionId": sessionId})
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := loadedModel.FindById(userId, nil, systemContext())
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, invalidTokenErr
+	}
+	roleNames, err := app.findUserRoles(userId)
+	if err != nil {
+		return nil, err
+	}
+	return app.issueTokens(user, roleNames, sessionId, mfa, ctx)
+}
+
+// claimStoredToken removes the stored token with jti and tokenType in a single operation and returns it, or nil if it
+// was already used. Concurrent requests with the same token cannot both claim it
+func (app *WeStack) claimStoredToken(jti interface{}, tokenType string) (*wst.M, error) {
+	return app.accessTokenModel.Datasource.FindOneAndDelete(app.accessTokenModel.CollectionName, wst.M{"jti": jti, "type": tokenType})
+}
+
+// revokeTokens removes the stored tokens matching where
+func (app *WeStack) revokeTokens(where wst.Where) error {
+	storedTokens, err := app.accessTokenModel.FindMany(&wst.Filter{Where: &where}, systemContext())
+	if err != nil {
+		return err
+	}
+	for _, storedToken := range storedTokens {
+		_, err := app.accessTokenModel.DeleteById(storedToken.Id, systemContext())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+logoutResult returns the response of logout and logout-all. Their refresh tokens are always revoked, but access tokens
+are only revoked when they are persisted. Otherwise they stay valid until they expire, and the response says so:
+{"accessTokenRevoked": false, "message": "..."}
+*/
+func (app *WeStack) logoutResult() (int, interface{}) {
+	if app.persistTokens() {
+		return fiber.StatusNoContent, ""
+	}
+	return fiber.StatusOK, wst.M{
+		"accessTokenRevoked": false,
+		"message":            "The access tokens stay valid until they expire. Enable jwt.persistTokens to revoke them on logout",
+	}
+}
+
+// isTokenActive reports whether the access token was not revoked. It is always true unless jwt.persistTokens is
+// enabled, and for tokens of external identity providers
+func (app *WeStack) isTokenActive(token *jwt.Token) (bool, error) {
+	if !app.persistTokens() || app.isExternalToken(token) {
+		return true, nil
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	jti, _ := claims["jti"].(string)
+	if jti == "" || app.accessTokenModel == nil {
+		return false, nil
+	}
+	storedTokens, err := app.accessTokenModel.FindMany(&wst.Filter{Where: &wst.Where{"jti": jti, "type": "access"}, Limit: 1}, systemContext())
+	if err != nil {
+		return false, err
+	}
+	return len(storedTokens) > 0, nil
+}
+
+/*
+findSessions returns the sessions of the user, with:
+  - id: the session id
+  - created, expiresAt: the dates of its current refresh token
+  - userAgent, ip: from the login request
+*/
+func (app *WeStack) findSessions(userId primitive.ObjectID) (wst.A, error) {
+	refreshTokens, err := app.accessTokenModel.FindMany(&wst.Filter{
+		Where: &wst.Where{"userId": userId, "type": "refresh"},
+		Order: &wst.Order{"created DESC"},
+	}, systemContext())
+	if err != nil {
+		return nil, err
+	}
+	sessions := make(wst.A, len(refreshTokens))
+	for idx, refreshToken := range refreshTokens {
+		data := refreshToken.ToJSON()
+		sessions[idx] = wst.M{
+			"id":        data["sessionId"],
+			"created":   data["created"],
+			"expiresAt": data["expiresAt"],
+			"userAgent": data["userAgent"],
+			"ip":        data["ip"],
+		}
+	}
+	return sessions, nil
+}
@@ -2,6 +2,7 @@ package westack
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -66,8 +67,53 @@ func (app *WeStack) loadModels() {
 		app.setupModel(loadedModel, dataSource)
 	}
 
+	app.setupAuditModel()
+
 	for _, loadedModel := range *app.modelRegistry {
 		fixRelations(loadedModel)
+		loadedModel.ValidateOnDelete()
+	}
+}
+
+// setupAuditModel assigns the model that stores the history of every model with "audit": true. It is the model named
+// by audit.model in config.json if it exists, or else an internal model stored in audit.datasource
+func (app *WeStack) setupAuditModel() {
+	var auditedModels []*model.Model
+	for _, loadedModel := range *app.modelRegistry {
+		if loadedModel.Config.Audit {
+			auditedModels = append(auditedModels, loadedModel)
+		}
+	}
+	if len(auditedModels) == 0 {
+		return
+	}
+
+	auditModelName := app.viper.GetString("audit.model")
+	if auditModelName == "" {
+		auditModelName = model.DefaultAuditModelName
+	}
+	auditModel := (*app.modelRegistry)[auditModelName]
+	if auditModel == nil {
+		dataSource := auditedModels[0].Datasource
+		if dsName := app.viper.GetString("audit.datasource"); dsName != "" {
+			dataSource = (*app.datasources)[dsName]
+			if dataSource == nil {
+				panic(fmt.Sprintf("ERROR: Missing audit datasource %v", dsName))
+			}
+		}
+		auditModel = model.New(&model.Config{
+			Name:       auditModelName,
+			Plural:     "audit-logs",
+			Base:       "PersistedModel",
+			Public:     false,
+			Properties: nil,
+			Relations:  &map[string]*model.Relation{},
+		}, app.modelRegistry)
+		app.setupModel(auditModel, dataSource)
+	}
+
+	for _, loadedModel := range auditedModels {
+		loadedModel.AuditModel = auditModel
 	}
 }
 func (app *WeStack) loadDataSources() {
@@ -111,7 +157,7 @@ func (app *WeStack) loadDataSources() {
 			dsName = key
 		}
 		connector := dsViper.GetString(key + ".connector")
-		if connector == "mongodb" /* || connector == "memory"*/ || connector == "redis" {
+		if connector == "mongodb" /* || connector == "memory"*/ || connector == "redis" || connector == "mail" {
 			ds := datasource.New(key, dsViper, ctx)
 
 			if app.dataSourceOptions != nil {
@@ -139,8 +185,19 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 
 	config := loadedModel.Config
 
+	if config.Base == "User" {
+		hideMfa(config)
+		// Links sent by email are not built from the Host header, fail at boot instead of at the first request
+		app.resetPasswordUrl()
+		app.verifyMailUrl(loadedModel)
+	}
 	loadedModel.Initialize()
 
+	err := loadedModel.EnsureIndexes()
+	if err != nil {
+		panic(fmt.Sprintf("Could not create indexes for %v: %v", loadedModel.Name, err))
+	}
+
 	if config.Base == "Role" {
 		roleMappingModel := model.New(&model.Config{
 			Name:   "RoleMapping",
@@ -176,82 +233,263 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 		app.setupModel(roleMappingModel, dataSource)
 	}
 
+	if config.Base == "User" && app.accessTokenModel == nil {
+		accessTokenModel := model.New(&model.Config{
+			Name:       "AccessToken",
+			Plural:     "access-tokens",
+			Base:       "PersistedModel",
+			Public:     false,
+			Properties: nil,
+			Relations:  &map[string]*model.Relation{},
+		}, app.modelRegistry)
+		accessTokenModel.App = app.asInterface()
+		accessTokenModel.Datasource = dataSource
+
+		app.accessTokenModel = accessTokenModel
+		app.setupModel(accessTokenModel, dataSource)
+	}
+
+	if config.Base == "User" && app.userIdentityModel == nil {
+		userIdentityModel := model.New(&model.Config{
+			Name:       "UserIdentity",
+			Plural:     "user-identities",
+			Base:       "PersistedModel",
+			Public:     false,
+			Properties: nil,
+			Relations:  &map[string]*model.Relation{},
+		}, app.modelRegistry)
+		userIdentityModel.App = app.asInterface()
+		userIdentityModel.Datasource = dataSource
+
+		app.userIdentityModel = userIdentityModel
+		app.setupModel(userIdentityModel, dataSource)
+	}
+
 	if config.Base == "User" {
 
 		loadedModel.On("login", func(ctx *model.EventContext) error {
 			data := ctx.Data
-			if (*data)["email"] == nil || strings.TrimSpace((*data)["email"].(string)) == "" {
-				return wst.CreateError(fiber.ErrBadRequest, "USERNAME_EMAIL_REQUIRED", fiber.Map{"message": "username or email is required"}, "ValidationError")
+			var firstUser *model.Instance
+			err := app.checkLoginAttempt(loadedModel, ctx, func() (*model.Instance, error) {
+				var err error
+				firstUser, err = findLoginUser(loadedModel, *data)
+				if err != nil {
+					return nil, err
+				}
+				password, _ := (*data)["password"].(string)
+				if firstUser == nil || strings.TrimSpace(password) == "" {
+					return firstUser, wst.CreateError(fiber.ErrUnauthorized, "LOGIN_FAILED", fiber.Map{"message": "login failed"}, "Error")
+				}
+
+				savedPassword := firstUser.GetString("password")
+				err = bcrypt.CompareHashAndPassword([]byte(savedPassword), []byte(password))
+				if err != nil {
+					return firstUser, wst.CreateError(fiber.ErrUnauthorized, "LOGIN_FAILED", fiber.Map{"message": "login failed"}, "Error")
+				}
+				return firstUser, nil
+			})
+			if err != nil {
+				return err
 			}
+			ctx.Instance = firstUser
 
-			if (*data)["password"] == nil || strings.TrimSpace((*data)["password"].(string)) == "" {
-				return wst.CreateError(fiber.ErrUnauthorized, "LOGIN_FAILED", fiber.Map{"message": "login failed"}, "Error")
+			tokens, err := app.completeLogin(firstUser, ctx)
+			if err != nil {
+				return err
 			}
 
-			email := (*data)["email"].(string)
-			users, err := loadedModel.FindMany(&wst.Filter{
-				Where: &wst.Where{
-					"email": email,
-				},
-			}, ctx)
-			if len(users) == 0 {
-				return wst.CreateError(fiber.ErrUnauthorized, "LOGIN_FAILED", fiber.Map{"message": "login failed"}, "Error")
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = tokens
+			return nil
+		})
+
+		loadedModel.On("refresh", func(ctx *model.EventContext) error {
+			refreshToken, _ := (*ctx.Data)["refreshToken"].(string)
+			if strings.TrimSpace(refreshToken) == "" {
+				return wst.CreateError(fiber.ErrBadRequest, "REFRESH_TOKEN_REQUIRED", fiber.Map{"message": "refreshToken is required"}, "ValidationError")
 			}
-			firstUser := users[0]
-			ctx.Instance = &firstUser
+			tokens, err := app.refreshTokens(loadedModel, refreshToken, ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = tokens
+			return nil
+		})
 
-			firstUserData := firstUser.ToJSON()
-			savedPassword := firstUserData["password"]
-			err = bcrypt.CompareHashAndPassword([]byte(savedPassword.(string)), []byte((*data)["password"].(string)))
+		loadedModel.On("resetPassword", func(ctx *model.EventContext) error {
+			err := app.requestPasswordReset(loadedModel, ctx)
 			if err != nil {
-				return wst.CreateError(fiber.ErrUnauthorized, "LOGIN_FAILED", fiber.Map{"message": "login failed"}, "Error")
+				return err
 			}
+			ctx.StatusCode = fiber.StatusNoContent
+			ctx.Result = ""
+			return nil
+		})
 
-			userIdHex := firstUser.Id.(primitive.ObjectID).Hex()
+		loadedModel.On("resetPasswordConfirm", func(ctx *model.EventContext) error {
+			err := app.confirmPasswordReset(loadedModel, ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusNoContent
+			ctx.Result = ""
+			return nil
+		})
 
-			roleNames := []string{"USER"}
-			if app.roleMappingModel != nil {
-				ctx.Bearer = &model.BearerToken{
-					User: &model.BearerUser{
-						System: true,
-					},
-					Roles: []model.BearerRole{},
-				}
-				roleContext := &model.EventContext{
-					BaseContext:            ctx,
-					DisableTypeConversions: true,
-				}
-				roleEntries, err := app.roleMappingModel.FindMany(&wst.Filter{Where: &wst.Where{
-					"principalType": "USER",
-					"$or": []wst.M{
-						{
-							"principalId": userIdHex,
-						},
-						{
-							"principalId": firstUser.Id,
-						},
-					},
-				}, Include: &wst.Include{{Relation: "role"}}}, roleContext)
-				if err != nil {
-					return err
-				}
-				for _, roleEntry := range roleEntries {
-					role := roleEntry.GetOne("role")
-					roleNames = append(roleNames, role.ToJSON()["name"].(string))
-				}
+		loadedModel.On("changePassword", func(ctx *model.EventContext) error {
+			err := app.changePassword(loadedModel, ctx)
+			if err != nil {
+				return err
 			}
+			ctx.StatusCode = fiber.StatusNoContent
+			ctx.Result = ""
+			return nil
+		})
 
-			token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-				"userId":  userIdHex,
-				"created": time.Now().UnixMilli(),
-				"ttl":     604800 * 2 * 1000,
-				"roles":   roleNames,
-			})
+		loadedModel.On("changeEmail", func(ctx *model.EventContext) error {
+			err := app.changeEmail(loadedModel, ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusNoContent
+			ctx.Result = ""
+			return nil
+		})
+
+		loadedModel.On("deleteSelf", func(ctx *model.EventContext) error {
+			err := app.deleteSelf(loadedModel, ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusNoContent
+			ctx.Result = ""
+			return nil
+		})
+
+		loadedModel.On("mfaSetup", func(ctx *model.EventContext) error {
+			result, err := app.mfaSetup(loadedModel, ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = result
+			return nil
+		})
+
+		loadedModel.On("mfaVerify", func(ctx *model.EventContext) error {
+			result, err := app.mfaVerify(loadedModel, ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = result
+			return nil
+		})
+
+		loadedModel.On("mfaDisable", func(ctx *model.EventContext) error {
+			err := app.mfaDisable(loadedModel, ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusNoContent
+			ctx.Result = ""
+			return nil
+		})
+
+		loadedModel.On("loginMfa", func(ctx *model.EventContext) error {
+			tokens, err := app.loginMfa(loadedModel, ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = tokens
+			return nil
+		})
 
-			tokenString, err := token.SignedString(loadedModel.App.JwtSecretKey)
+		loadedModel.On("oauthLogin", func(ctx *model.EventContext) error {
+			authorizeUrl, err := app.oauthAuthorizeUrl(loadedModel, ctx.Ctx.Params("provider"), ctx.Ctx)
+			if err != nil {
+				return err
+			}
+			ctx.Ctx.Set(fiber.HeaderLocation, authorizeUrl)
+			ctx.StatusCode = fiber.StatusFound
+			ctx.Result = fiber.Map{"location": authorizeUrl}
+			return nil
+		})
 
+		loadedModel.On("oauthCallback", func(ctx *model.EventContext) error {
+			providerName := ctx.Ctx.Params("provider")
+			tokens, successRedirect, err := app.oauthCallback(loadedModel, providerName, ctx)
+			if err != nil {
+				return err
+			}
+			if successRedirect != "" {
+				successUrl := oauthSuccessUrl(successRedirect, tokens)
+				ctx.Ctx.Set(fiber.HeaderLocation, successUrl)
+				ctx.StatusCode = fiber.StatusFound
+				ctx.Result = fiber.Map{}
+				return nil
+			}
 			ctx.StatusCode = fiber.StatusOK
-			ctx.Result = fiber.Map{"id": tokenString, "userId": userIdHex}
+			ctx.Result = tokens
+			return nil
+		})
+
+		loadedModel.On("logout", func(ctx *model.EventContext) error {
+			err, token := ctx.GetBearer(loadedModel)
+			if err != nil {
+				return err
+			}
+			sessionId, _ := token.Claims["sid"].(string)
+			if token.User == nil || sessionId == "" {
+				return wst.CreateError(fiber.ErrUnauthorized, "UNAUTHORIZED", fiber.Map{"message": "a session token is required"}, "Error")
+			}
+			err = app.revokeTokens(wst.Where{"sessionId": sessionId})
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode, ctx.Result = app.logoutResult()
+			return nil
+		})
+
+		loadedModel.On("logoutAll", func(ctx *model.EventContext) error {
+			err, token := ctx.GetBearer(loadedModel)
+			if err != nil {
+				return err
+			}
+			if token.User == nil {
+				return wst.CreateError(fiber.ErrUnauthorized, "UNAUTHORIZED", fiber.Map{"message": "a session token is required"}, "Error")
+			}
+			userId, err := primitive.ObjectIDFromHex(fmt.Sprintf("%v", token.User.Id))
+			if err != nil {
+				return err
+			}
+			err = app.revokeTokens(wst.Where{"userId": userId})
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode, ctx.Result = app.logoutResult()
+			return nil
+		})
+
+		loadedModel.On("instance_sessions", func(ctx *model.EventContext) error {
+			sessions, err := app.findSessions(*ctx.ModelID.(*primitive.ObjectID))
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = sessions
+			return nil
+		})
+
+		loadedModel.On("instance_revokeSession", func(ctx *model.EventContext) error {
+			err := app.revokeTokens(wst.Where{"userId": *ctx.ModelID.(*primitive.ObjectID), "sessionId": ctx.Ctx.Params("sessionId")})
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusNoContent
+			ctx.Result = ""
 			return nil
 		})
 
@@ -268,7 +506,7 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 	casbModel := casbinmodel.NewModel()
 
 	basePoliciesDirectory := app.viper.GetString("casbin.policies.outputDirectory")
-	_, err := os.Stat(basePoliciesDirectory)
+	_, err = os.Stat(basePoliciesDirectory)
 	if err != nil {
 		if os.IsNotExist(err) {
 			err = os.MkdirAll(basePoliciesDirectory, os.ModePerm)
@@ -333,8 +571,24 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 	if config.Base == "User" {
 		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,create,allow")})
 		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,login,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,refresh,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,resetPassword,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,resetPasswordConfirm,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,performEmailVerification,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,oauthLogin,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,oauthCallback,allow")})
 		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$owner,*,*,allow")})
 		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,findSelf,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,logout,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,logoutAll,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,changePassword,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,changeEmail,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,sendVerificationEmail,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,deleteSelf,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$everyone,*,loginMfa,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,mfaSetup,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,mfaVerify,allow")})
+		casbModel.AddPolicy("p", "p", []string{replaceVarNames("$authenticated,*,mfaDisable,allow")})
 	}
 
 	loadedModel.CasbinModel = &casbModel
@@ -354,6 +608,9 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 		loadedModel.BaseUrl = app.restApiRoot + "/" + plural
 
 		loadedModel.On("findMany", func(ctx *model.EventContext) error {
+			if ctx.Ctx != nil && strings.Contains(ctx.Ctx.Get(fiber.HeaderAccept), ndjsonContentType) {
+				return streamFindMany(loadedModel, ctx)
+			}
 			result, err := loadedModel.FindMany(ctx.Filter, ctx)
 			out := make(wst.A, len(result))
 			for idx, item := range result {
@@ -368,6 +625,63 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 			ctx.Result = out
 			return nil
 		})
+		loadedModel.On("aggregate", func(ctx *model.EventContext) error {
+			var where *wst.Where
+			if whereSt, _ := (*ctx.Query)["where"].(string); whereSt != "" {
+				err := json.Unmarshal([]byte(whereSt), &where)
+				if err != nil {
+					return wst.CreateError(fiber.ErrBadRequest, "INVALID_WHERE", fiber.Map{"message": err.Error()}, "ValidationError")
+				}
+			}
+			groupBy, _ := (*ctx.Query)["groupBy"].(string)
+			metrics, _ := (*ctx.Query)["metrics"].(string)
+			result, err := loadedModel.Aggregate(where, splitQueryList(groupBy), splitQueryList(metrics), ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = result
+			return nil
+		})
+		loadedModel.On("search", func(ctx *model.EventContext) error {
+			filterMap := ctx.Filter
+			if filterMap == nil {
+				filterMap = &wst.Filter{}
+			}
+			filterMap.Search, _ = (*ctx.Query)["q"].(string)
+			if strings.TrimSpace(filterMap.Search) == "" {
+				return wst.CreateError(fiber.ErrBadRequest, "INVALID_SEARCH", fiber.Map{"message": "q is required"}, "ValidationError")
+			}
+			result, err := loadedModel.FindMany(filterMap, ctx)
+			if err != nil {
+				return err
+			}
+			out := make(wst.A, len(result))
+			for idx, item := range result {
+				item.HideProperties()
+				out[idx] = item.ToJSON()
+			}
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = out
+			return nil
+		})
+		for scopeName := range loadedModel.Config.Scopes {
+			scopeName := scopeName
+			loadedModel.On(fmt.Sprintf("__scope__%v", scopeName), func(ctx *model.EventContext) error {
+				result, err := loadedModel.Scope(scopeName, ctx.Filter, ctx)
+				if err != nil {
+					return err
+				}
+				out := make(wst.A, len(result))
+				for idx, item := range result {
+					item.HideProperties()
+					out[idx] = item.ToJSON()
+				}
+				ctx.StatusCode = fiber.StatusOK
+				ctx.Result = out
+				return nil
+			})
+		}
 		loadedModel.On("findById", func(ctx *model.EventContext) error {
 			result, err := loadedModel.FindById(ctx.ModelID, ctx.Filter, ctx)
 			if result != nil {
@@ -376,6 +690,9 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 			if err != nil {
 				return err
 			}
+			if result != nil && loadedModel.Config.Versioned {
+				ctx.Ctx.Set(fiber.HeaderETag, fmt.Sprintf("\"%v\"", result.GetVersion()))
+			}
 			ctx.StatusCode = fiber.StatusOK
 			ctx.Result = result.ToJSON()
 			return nil
@@ -384,6 +701,15 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 		loadedModel.Observe("before save", func(ctx *model.EventContext) error {
 			data := ctx.Data
 
+			// The MFA settings can only be changed through the mfa endpoints, and the email, its verification and the
+			// password through the account endpoints
+			if config.Base == "User" && !ctx.SkipFieldProtection {
+				err := rejectProtectedFields(*data, protectedUserFields(ctx.IsNewInstance))
+				if err != nil {
+					return err
+				}
+			}
+
 			if (*data)["modified"] == nil {
 				timeNow := time.Now()
 				(*data)["modified"] = timeNow
@@ -401,24 +727,9 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 						// TODO: Validate email
 						return wst.CreateError(fiber.ErrBadRequest, "EMAIL_PRESENCE", fiber.Map{"message": "Invalid email", "codes": wst.M{"email": []string{"presence"}}}, "ValidationError")
 					}
-					filter := wst.Filter{Where: &wst.Where{"email": email}}
-					existent, err2 := loadedModel.FindOne(&filter, ctx)
-					if err2 != nil {
-						return err2
-					}
-					if existent != nil {
-						return wst.CreateError(fiber.ErrConflict, "EMAIL_UNIQUENESS", fiber.Map{"message": fmt.Sprintf("The `user` instance is not valid. Details: `email` Email already exists (value: \"%v\").", email), "codes": wst.M{"email": []string{"uniqueness"}}}, "ValidationError")
-					}
-					username := (*data)["username"]
-					if username != nil && strings.TrimSpace(username.(string)) != "" {
-						filter = wst.Filter{Where: &wst.Where{"username": username}}
-						existent, err2 = loadedModel.FindOne(&filter, ctx)
-						if err2 != nil {
-							return err2
-						}
-						if existent != nil {
-							return wst.CreateError(fiber.ErrConflict, "USERNAME_UNIQUENESS", fiber.Map{"message": fmt.Sprintf("The `user` instance is not valid. Details: `username` User already exists (value: \"%v\").", username), "codes": wst.M{"username": []string{"uniqueness"}}}, "ValidationError")
-						}
+					err := checkIdentifiersUniqueness(loadedModel, *data, nil)
+					if err != nil {
+						return err
 					}
 
 					if (*data)["password"] == nil || strings.TrimSpace((*data)["password"].(string)) == "" {
@@ -437,6 +748,16 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 
 			} else {
 				if config.Base == "User" {
+					previousValues := wst.M{}
+					if ctx.PreviousValues != nil {
+						previousValues = *ctx.PreviousValues
+					}
+					if identifiers := updatedIdentifiers(loadedModel, *data, previousValues); identifiers != nil {
+						err := checkIdentifiersUniqueness(loadedModel, identifiers, ctx.ModelID)
+						if err != nil {
+							return err
+						}
+					}
 					if (*data)["password"] != nil && (*data)["password"] != "" {
 						log.Println("Update User password")
 						hashed, err := bcrypt.GenerateFromPassword([]byte((*data)["password"].(string)), 10)
@@ -471,13 +792,16 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 			if err != nil {
 				return err
 			}
+			if loadedModel.Config.Versioned {
+				ctx.Ctx.Set(fiber.HeaderETag, fmt.Sprintf("\"%v\"", updated.GetVersion()))
+			}
 			ctx.StatusCode = fiber.StatusOK
 			ctx.Result = updated.ToJSON()
 			return nil
 		})
 
 		deleteByIdHandler := func(ctx *model.EventContext) error {
-			deletedCount, err := loadedModel.DeleteById(ctx.ModelID)
+			deletedCount, err := loadedModel.DeleteById(ctx.ModelID, ctx)
 			if err != nil {
 				return err
 			}
@@ -489,6 +813,37 @@ func (app *WeStack) setupModel(loadedModel *model.Model, dataSource *datasource.
 			return nil
 		}
 		loadedModel.On("instance_delete", deleteByIdHandler)
+		loadedModel.On("instance_history", func(ctx *model.EventContext) error {
+			result, err := loadedModel.History(ctx.ModelID, ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = result.ToJSON()
+			return nil
+		})
+		loadedModel.On("instance_restore", func(ctx *model.EventContext) error {
+			restored, err := loadedModel.Restore(ctx.ModelID, ctx)
+			if err != nil {
+				return err
+			}
+			if restored == nil {
+				return wst.CreateError(fiber.ErrNotFound, "NOT_FOUND", fiber.Map{"message": fmt.Sprintf("Could not find %v with id %v", loadedModel.Name, ctx.ModelID)}, "Error")
+			}
+			restored.HideProperties()
+			ctx.StatusCode = fiber.StatusOK
+			ctx.Result = restored.ToJSON()
+			return nil
+		})
+		loadedModel.On("instance_purge", func(ctx *model.EventContext) error {
+			_, err := loadedModel.Purge(ctx.ModelID, ctx)
+			if err != nil {
+				return err
+			}
+			ctx.StatusCode = fiber.StatusNoContent
+			ctx.Result = ""
+			return nil
+		})
 
 	}
 }
@@ -497,6 +852,10 @@ func (app *WeStack) asInterface() *wst.IApp {
 	return &wst.IApp{
 		Debug:        app.debug,
 		JwtSecretKey: app.jwtSecretKey,
+		JwtKeyFunc:   app.jwtKeyFunc,
+		IsTokenActive: func(token *jwt.Token) (bool, error) {
+			return app.isTokenActive(token)
+		},
 		FindModel: func(modelName string) (interface{}, error) {
 			return app.FindModel(modelName)
 		},
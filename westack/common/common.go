@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -92,8 +93,10 @@ func AFromPrimitiveSlice(in *primitive.A) *A {
 type Where M
 
 type IncludeItem struct {
-	Relation string  `json:"relation"`
-	Scope    *Filter `json:"scope"`
+	Relation  string  `json:"relation"`
+	Scope     *Filter `json:"scope"`
+	Recursive bool    `json:"recursive"`
+	MaxDepth  int     `json:"maxDepth"`
 }
 
 type Include []IncludeItem
@@ -105,6 +108,7 @@ type Filter struct {
 	Order   *Order   `json:"order"`
 	Skip    int64    `json:"skip"`
 	Limit   int64    `json:"limit"`
+	Search  string   `json:"search"`
 }
 
 type IApp struct {
@@ -113,6 +117,8 @@ type IApp struct {
 	FindModel      func(modelName string) (interface{}, error)
 	FindDatasource func(datasource string) (interface{}, error)
 	JwtSecretKey   []byte
+	JwtKeyFunc     jwt.Keyfunc
+	IsTokenActive  func(token *jwt.Token) (bool, error)
 }
 
 var RegexpIdEntire = regexp.MustCompile("^([0-9a-f]{24})$")
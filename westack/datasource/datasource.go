@@ -16,6 +16,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -52,7 +53,8 @@ type Datasource struct {
 	Context context.Context
 	Options *Options
 
-	ctxCancelFn context.CancelFunc
+	ctxCancelFn  context.CancelFunc
+	transactions bool
 }
 
 func (ds *Datasource) Initialize() error {
@@ -109,6 +111,17 @@ func (ds *Datasource) Initialize() error {
 			return err
 		}
 
+		// Transactions need a replica set or a sharded cluster
+		var hello struct {
+			SetName string `bson:"setName"`
+			Msg     string `bson:"msg"`
+		}
+		err = ds.Db.(*mongo.Client).Database("admin").RunCommand(mongoCtx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello)
+		if err != nil {
+			log.Printf("WARNING: Could not check if %v supports transactions: %v\n", ds.Name, err)
+		}
+		ds.transactions = hello.SetName != "" || hello.Msg == "isdbgrid"
+
 		init := time.Now().UnixMilli()
 		go func() {
 			for {
@@ -147,6 +160,8 @@ func (ds *Datasource) Initialize() error {
 		ds.Db = rClient
 
 		break
+	case "mail":
+		return ds.initializeMail()
 	//case "memory":
 	//	ds.Db = make(map[interface{}]interface{})
 	//	break
@@ -245,6 +260,68 @@ func (ds *Datasource) FindMany(collectionName string, lookups *wst.A) (*wst.A, e
 	return nil, errors.New(fmt.Sprintf("invalid connector %v", connector))
 }
 
+// FindEach runs the same query as FindMany but decodes the documents one by one from the cursor, invoking handler
+// for each of them. Iteration stops at the first error returned by handler, or when ctx is cancelled. A nil ctx uses the
+// context of the datasource.
+func (ds *Datasource) FindEach(ctx context.Context, collectionName string, lookups *wst.A, handler func(document wst.M) error) error {
+	var connector = ds.Viper.GetString(ds.Key + ".connector")
+	switch connector {
+	case "mongodb":
+		var db = ds.Db.(*mongo.Client)
+
+		database := db.Database(ds.Viper.GetString(ds.Key + ".database"))
+		collection := database.Collection(collectionName)
+
+		pipeline := wst.A{}
+
+		if lookups != nil {
+			pipeline = append(pipeline, *lookups...)
+		}
+		allowDiskUse := true
+		if ctx == nil {
+			ctx = ds.Context
+		}
+		cursor, err := collection.Aggregate(ctx, pipeline, &options.AggregateOptions{
+			AllowDiskUse: &allowDiskUse,
+		})
+		if err != nil {
+			return err
+		}
+		defer func(cursor *mongo.Cursor) {
+			// ctx may be already cancelled here, and the cursor must be closed anyway
+			err := cursor.Close(ds.Context)
+			if err != nil {
+				log.Println("WARNING: could not close cursor", err)
+			}
+		}(cursor)
+		for cursor.Next(ctx) {
+			var document wst.M
+			err := cursor.Decode(&document)
+			if err != nil {
+				return err
+			}
+			err = handler(document)
+			if err != nil {
+				return err
+			}
+		}
+		return cursor.Err()
+	case "redis":
+		documents, err := ds.FindMany(collectionName, lookups)
+		if err != nil {
+			return err
+		}
+		for _, document := range *documents {
+			err := handler(document)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return errors.New(fmt.Sprintf("invalid connector %v", connector))
+}
+
 func findByObjectId(collectionName string, _id interface{}, ds *Datasource, lookups *wst.A) (*wst.M, error) {
 	var connector = ds.Viper.GetString(ds.Key + ".connector")
 	switch connector {
@@ -367,7 +444,7 @@ func (ds *Datasource) UpdateById(collectionName string, id interface{}, data *ws
 		collection := database.Collection(collectionName)
 		delete(*data, "id")
 		delete(*data, "_id")
-		if _, err := collection.UpdateOne(ds.Context, wst.M{"_id": id}, wst.M{"$set": *data}); err != nil {
+		if _, err := collection.UpdateOne(ds.Context, wst.M{"_id": id}, BuildUpdate(*data)); err != nil {
 			panic(err)
 		}
 		return findByObjectId(collectionName, id, ds, nil)
@@ -375,6 +452,48 @@ func (ds *Datasource) UpdateById(collectionName string, id interface{}, data *ws
 	return nil, errors.New(fmt.Sprintf("invalid connector %v", connector))
 }
 
+// StartSession starts a session that can run transactions. Only mongodb datasources support them
+func (ds *Datasource) StartSession() (mongo.Session, error) {
+	var connector = ds.Viper.GetString(ds.Key + ".connector")
+	switch connector {
+	case "mongodb":
+		var db = ds.Db.(*mongo.Client)
+		return db.StartSession()
+	}
+	return nil, errors.New(fmt.Sprintf("connector %v does not support transactions", connector))
+}
+
+// SupportsTransactions reports whether StartSession can run transactions, only in mongodb replica sets and sharded
+// clusters
+func (ds *Datasource) SupportsTransactions() bool {
+	return ds.transactions
+}
+
+// WithContext returns a copy of the datasource that runs every operation with ctx, like a mongo.SessionContext
+func (ds *Datasource) WithContext(ctx context.Context) *Datasource {
+	dsCopy := *ds
+	dsCopy.Context = ctx
+	return &dsCopy
+}
+
+// BuildUpdate returns the update document for data. Keys starting with $ are update operators, like
+// {"$inc": {"views": 1}}, and the rest of the keys are written with $set
+func BuildUpdate(data wst.M) wst.M {
+	update := wst.M{}
+	set := wst.M{}
+	for key, value := range data {
+		if strings.HasPrefix(key, "$") {
+			update[key] = value
+		} else {
+			set[key] = value
+		}
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	return update
+}
+
 func (ds *Datasource) DeleteById(collectionName string, id interface{}) int64 {
 	var connector = ds.Viper.GetString(ds.Key + ".connector")
 	switch connector {
@@ -392,6 +511,65 @@ func (ds *Datasource) DeleteById(collectionName string, id interface{}) int64 {
 	return 0
 }
 
+// FindOneAndDelete removes the first document matching filter and returns it, or nil if no document matched. Only one
+// of concurrent calls with the same filter gets the document
+func (ds *Datasource) FindOneAndDelete(collectionName string, filter wst.M) (*wst.M, error) {
+	var connector = ds.Viper.GetString(ds.Key + ".connector")
+	switch connector {
+	case "mongodb":
+		var db = ds.Db.(*mongo.Client)
+
+		database := db.Database(ds.Viper.GetString(ds.Key + ".database"))
+		collection := database.Collection(collectionName)
+		var document wst.M
+		err := collection.FindOneAndDelete(ds.Context, filter).Decode(&document)
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return &document, nil
+	}
+	return nil, errors.New(fmt.Sprintf("invalid connector %v", connector))
+}
+
+// UpdateOne applies the update operators to the first document matching filter, and returns the number of matched
+// documents
+func (ds *Datasource) UpdateOne(collectionName string, filter wst.M, update wst.M) (int64, error) {
+	var connector = ds.Viper.GetString(ds.Key + ".connector")
+	switch connector {
+	case "mongodb":
+		var db = ds.Db.(*mongo.Client)
+
+		database := db.Database(ds.Viper.GetString(ds.Key + ".database"))
+		collection := database.Collection(collectionName)
+		result, err := collection.UpdateOne(ds.Context, filter, update)
+		if err != nil {
+			return 0, err
+		}
+		return result.MatchedCount, nil
+	}
+	return 0, errors.New(fmt.Sprintf("invalid connector %v", connector))
+}
+
+// CreateIndex creates the index if it does not exist yet
+func (ds *Datasource) CreateIndex(collectionName string, keys wst.M, name string) error {
+	var connector = ds.Viper.GetString(ds.Key + ".connector")
+	switch connector {
+	case "mongodb":
+		var db = ds.Db.(*mongo.Client)
+
+		database := db.Database(ds.Viper.GetString(ds.Key + ".database"))
+		collection := database.Collection(collectionName)
+		_, err := collection.Indexes().CreateOne(ds.Context, mongo.IndexModel{
+			Keys:    keys,
+			Options: options.Index().SetName(name),
+		})
+		return err
+	}
+	return errors.New(fmt.Sprintf("indexes are not supported by connector %v", connector))
+}
+
 func New(dsKey string, dsViper *viper.Viper, parentContext context.Context) *Datasource {
 	name := dsViper.GetString(dsKey + ".name")
 	if name == "" {
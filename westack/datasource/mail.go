@@ -0,0 +1,181 @@
+package datasource
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Mail is a message sent with a datasource of the "mail" connector
+type Mail struct {
+	From    string
+	To      []string
+	Subject string
+	Html    string
+	Text    string
+}
+
+/*
+initializeMail checks the settings of a "mail" datasource. The transport is one of:
+  - smtp: host, port, username, password and from. With "secure": true it uses implicit TLS, usually on port 465.
+    Otherwise STARTTLS is used when the server supports it
+  - file: writes every message as a .eml file in directory, for tests
+  - log: prints every message, for development, with the links redacted because they usually carry tokens
+*/
+func (ds *Datasource) initializeMail() error {
+	transport := ds.Viper.GetString(ds.Key + ".transport")
+	switch transport {
+	case "smtp":
+		if ds.Viper.GetString(ds.Key+".host") == "" {
+			return errors.New(fmt.Sprintf("mail datasource %v needs a host", ds.Name))
+		}
+		break
+	case "file":
+		directory := ds.Viper.GetString(ds.Key + ".directory")
+		if directory == "" {
+			return errors.New(fmt.Sprintf("mail datasource %v needs a directory", ds.Name))
+		}
+		err := os.MkdirAll(directory, os.ModePerm)
+		if err != nil {
+			return err
+		}
+		break
+	case "log":
+		break
+	default:
+		return errors.New(fmt.Sprintf("invalid mail transport %#v, use smtp, file or log", transport))
+	}
+	ds.Db = transport
+	return nil
+}
+
+// SendMail sends the message with the transport of the datasource. From defaults to the "from" setting
+func (ds *Datasource) SendMail(mail Mail) error {
+	var connector = ds.Viper.GetString(ds.Key + ".connector")
+	if connector != "mail" {
+		return errors.New(fmt.Sprintf("connector %v cannot send mails", connector))
+	}
+	if mail.From == "" {
+		mail.From = ds.Viper.GetString(ds.Key + ".from")
+	}
+	if mail.From == "" || len(mail.To) == 0 {
+		return errors.New("mails need a sender and at least one recipient")
+	}
+	for _, address := range append([]string{mail.From}, mail.To...) {
+		if strings.ContainsAny(address, "\r\n") {
+			return errors.New(fmt.Sprintf("invalid mail address %#v", address))
+		}
+	}
+	message := buildMessage(mail)
+
+	switch ds.Db.(string) {
+	case "smtp":
+		return ds.sendSmtp(mail, message)
+	case "file":
+		fileName := fmt.Sprintf("%v-%v.eml", time.Now().Format("20060102T150405"), uuid.New().String())
+		return os.WriteFile(filepath.Join(ds.Viper.GetString(ds.Key+".directory"), fileName), message, 0644)
+	case "log":
+		log.Printf("Mail from %v to %v:\n%v\n", mail.From, strings.Join(mail.To, ", "), redactLinks(string(message)))
+		return nil
+	}
+	return errors.New(fmt.Sprintf("invalid mail transport %v", ds.Db))
+}
+
+func (ds *Datasource) sendSmtp(mail Mail, message []byte) error {
+	host := ds.Viper.GetString(ds.Key + ".host")
+	port := ds.Viper.GetInt(ds.Key + ".port")
+	if port == 0 {
+		port = 587
+	}
+	address := net.JoinHostPort(host, fmt.Sprintf("%v", port))
+	var auth smtp.Auth
+	if username := ds.Viper.GetString(ds.Key + ".username"); username != "" {
+		auth = smtp.PlainAuth("", username, ds.Viper.GetString(ds.Key+".password"), host)
+	}
+	if !ds.Viper.GetBool(ds.Key + ".secure") {
+		return smtp.SendMail(address, auth, mail.From, mail.To, message)
+	}
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: host})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if auth != nil {
+		err = client.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(mail.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range mail.To {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(message)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+var linkRegexp = regexp.MustCompile(`(?i)https?://[^\s"'<>]+`)
+
+// redactLinks replaces the urls in message, so the tokens in them do not end up in the logs
+func redactLinks(message string) string {
+	return linkRegexp.ReplaceAllString(message, "[redacted link]")
+}
+
+// buildMessage returns the message in RFC 5322 format, as multipart/alternative when it has both html and text
+func buildMessage(mail Mail) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("From: " + mail.From + "\r\n")
+	buffer.WriteString("To: " + strings.Join(mail.To, ", ") + "\r\n")
+	buffer.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", mail.Subject) + "\r\n")
+	buffer.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+
+	if mail.Html != "" && mail.Text != "" {
+		boundary := uuid.New().String()
+		buffer.WriteString("Content-Type: multipart/alternative; boundary=\"" + boundary + "\"\r\n\r\n")
+		buffer.WriteString("--" + boundary + "\r\n")
+		buffer.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n" + mail.Text + "\r\n")
+		buffer.WriteString("--" + boundary + "\r\n")
+		buffer.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n" + mail.Html + "\r\n")
+		buffer.WriteString("--" + boundary + "--\r\n")
+	} else if mail.Html != "" {
+		buffer.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n" + mail.Html + "\r\n")
+	} else {
+		buffer.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n" + mail.Text + "\r\n")
+	}
+	return buffer.Bytes()
+}
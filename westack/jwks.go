@@ -0,0 +1,481 @@
+package westack
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+)
+
+// Unknown kids trigger a new download of the external JWKS urls, at most once per jwksMinRefreshInterval
+const jwksMinRefreshInterval = 5 * time.Minute
+
+// jwtKeyConfig is an entry of jwt.keys in config.json. The PEM can be given inline or as a file path
+type jwtKeyConfig struct {
+	Kid            string `mapstructure:"kid"`
+	Algorithm      string `mapstructure:"algorithm"`
+	PrivateKey     string `mapstructure:"privateKey"`
+	PrivateKeyFile string `mapstructure:"privateKeyFile"`
+	PublicKey      string `mapstructure:"publicKey"`
+	PublicKeyFile  string `mapstructure:"publicKeyFile"`
+}
+
+// jwksSourceConfig is an entry of jwt.jwks in config.json, a JWKS of an external identity provider
+type jwksSourceConfig struct {
+	Url      string               `mapstructure:"url"`
+	File     string               `mapstructure:"file"`
+	Issuer   string               `mapstructure:"issuer"`
+	Audience string               `mapstructure:"audience"`
+	MapRoles []externalRoleConfig `mapstructure:"mapRoles"`
+}
+
+// externalRoleConfig grants the local role To to the external tokens whose roles claim contains From
+type externalRoleConfig struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+type jwtKey struct {
+	kid        string
+	method     jwt.SigningMethod
+	privateKey interface{}
+	publicKey  interface{}
+	// Source of the external keys
+	source *jwksSourceConfig
+}
+
+type jwtKeySet struct {
+	signingKey *jwtKey
+	local      map[string]*jwtKey
+	external   map[string]*jwtKey
+	sources    []jwksSourceConfig
+	lastFetch  time.Time
+	mutex      sync.RWMutex
+}
+
+/*
+loadJwtKeys reads the asymmetric keys from config.json. Tokens are signed with the key jwt.signingKey, or the first one
+with a private key. The rest of the keys are kept to verify tokens signed before a rotation:
+
+	"jwt": {
+	  "signingKey": "2022-06",
+	  "keys": [
+	    {"kid": "2022-06", "algorithm": "RS256", "privateKeyFile": "server/keys/2022-06.pem"},
+	    {"kid": "2022-01", "algorithm": "RS256", "publicKeyFile": "server/keys/2022-01.pub.pem"}
+	  ],
+	  "jwks": [
+	    {"url": "https://idp.example.com/.well-known/jwks.json", "issuer": "https://idp.example.com/", "audience": "my-api"}
+	  ]
+	}
+
+Without keys, tokens are signed with HS256 and JWT_SECRET, which is then required. HS256 tokens are rejected when
+JWT_SECRET is empty
+*/
+func (app *WeStack) loadJwtKeys() {
+	keySet := &jwtKeySet{
+		local:    map[string]*jwtKey{},
+		external: map[string]*jwtKey{},
+	}
+
+	var keyConfigs []jwtKeyConfig
+	err := app.viper.UnmarshalKey("jwt.keys", &keyConfigs)
+	if err != nil {
+		panic(fmt.Errorf("invalid jwt.keys: %w", err))
+	}
+	signingKid := app.viper.GetString("jwt.signingKey")
+	for _, keyConfig := range keyConfigs {
+		key, err := parseJwtKey(keyConfig)
+		if err != nil {
+			panic(fmt.Errorf("invalid jwt key %v: %w", keyConfig.Kid, err))
+		}
+		if _, exists := keySet.local[key.kid]; exists {
+			panic(fmt.Sprintf("duplicated jwt key %v", key.kid))
+		}
+		keySet.local[key.kid] = key
+		if key.privateKey != nil && keySet.signingKey == nil && (signingKid == "" || signingKid == key.kid) {
+			keySet.signingKey = key
+		}
+	}
+	if signingKid != "" && keySet.signingKey == nil {
+		panic(fmt.Sprintf("jwt.signingKey %v not found or without private key", signingKid))
+	}
+	if keySet.signingKey == nil && len(app.jwtSecretKey) == 0 {
+		// Anybody could sign HS256 tokens with an empty secret
+		panic("JWT_SECRET is required when jwt.keys has no private key")
+	}
+
+	err = app.viper.UnmarshalKey("jwt.jwks", &keySet.sources)
+	if err != nil {
+		panic(fmt.Errorf("invalid jwt.jwks: %w", err))
+	}
+	for _, source := range keySet.sources {
+		if source.Url == "" && source.File == "" {
+			panic("every entry of jwt.jwks needs a url or a file")
+		}
+		if source.Audience == "" {
+			panic(fmt.Sprintf("jwt.jwks %v%v needs an audience", source.File, source.Url))
+		}
+	}
+	err = keySet.fetchExternalKeys()
+	if err != nil {
+		panic(err)
+	}
+
+	app.jwtKeys = keySet
+}
+
+func parseJwtKey(keyConfig jwtKeyConfig) (*jwtKey, error) {
+	if keyConfig.Kid == "" {
+		return nil, fmt.Errorf("kid is required")
+	}
+	method := jwt.GetSigningMethod(keyConfig.Algorithm)
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		break
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %v, use RS256, RS384, RS512, ES256, ES384 or ES512", keyConfig.Algorithm)
+	}
+	_, isRSA := method.(*jwt.SigningMethodRSA)
+
+	privatePem, err := readPem(keyConfig.PrivateKey, keyConfig.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	publicPem, err := readPem(keyConfig.PublicKey, keyConfig.PublicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jwtKey{kid: keyConfig.Kid, method: method}
+	if privatePem != nil {
+		if isRSA {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privatePem)
+			if err != nil {
+				return nil, err
+			}
+			key.privateKey = privateKey
+			key.publicKey = &privateKey.PublicKey
+		} else {
+			privateKey, err := jwt.ParseECPrivateKeyFromPEM(privatePem)
+			if err != nil {
+				return nil, err
+			}
+			key.privateKey = privateKey
+			key.publicKey = &privateKey.PublicKey
+		}
+	} else if publicPem != nil {
+		if isRSA {
+			key.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(publicPem)
+		} else {
+			key.publicKey, err = jwt.ParseECPublicKeyFromPEM(publicPem)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("a private or public key is required")
+	}
+	return key, nil
+}
+
+func readPem(inline string, path string) ([]byte, error) {
+	if inline != "" {
+		return []byte(inline), nil
+	}
+	if path != "" {
+		return ioutil.ReadFile(path)
+	}
+	return nil, nil
+}
+
+// fetchExternalKeys downloads or reads again every configured JWKS
+func (keySet *jwtKeySet) fetchExternalKeys() error {
+	if len(keySet.sources) == 0 {
+		return nil
+	}
+	external := map[string]*jwtKey{}
+	for idx := range keySet.sources {
+		source := &keySet.sources[idx]
+		var raw []byte
+		var err error
+		if source.File != "" {
+			raw, err = ioutil.ReadFile(source.File)
+		} else {
+			raw, err = downloadJwks(source.Url)
+		}
+		if err != nil {
+			return fmt.Errorf("could not load jwks %v%v: %w", source.File, source.Url, err)
+		}
+		keys, err := parseJwks(raw, source)
+		if err != nil {
+			return fmt.Errorf("invalid jwks %v%v: %w", source.File, source.Url, err)
+		}
+		for _, key := range keys {
+			external[key.kid] = key
+		}
+	}
+
+	keySet.mutex.Lock()
+	defer keySet.mutex.Unlock()
+	keySet.external = external
+	keySet.lastFetch = time.Now()
+	return nil
+}
+
+func downloadJwks(url string) ([]byte, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", response.StatusCode)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// parseJwks returns the RSA and EC signing keys of the set. Other keys, like encryption keys, are ignored
+func parseJwks(raw []byte, source *jwksSourceConfig) ([]*jwtKey, error) {
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(raw, &keySet)
+	if err != nil {
+		return nil, err
+	}
+	var result []*jwtKey
+	for _, jwk := range keySet.Keys {
+		if jwk.Kid == "" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key := &jwtKey{kid: jwk.Kid, source: source}
+		if jwk.Alg != "" {
+			key.method = jwt.GetSigningMethod(jwk.Alg)
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+			if err != nil {
+				return nil, err
+			}
+			e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+			if err != nil {
+				return nil, err
+			}
+			key.publicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			break
+		case "EC":
+			curve := curveByName(jwk.Crv)
+			if curve == nil {
+				return nil, fmt.Errorf("unsupported curve %v in key %v", jwk.Crv, jwk.Kid)
+			}
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if err != nil {
+				return nil, err
+			}
+			y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if err != nil {
+				return nil, err
+			}
+			key.publicKey = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			break
+		default:
+			continue
+		}
+		result = append(result, key)
+	}
+	return result, nil
+}
+
+func curveByName(name string) elliptic.Curve {
+	switch name {
+	case "P-256":
+		return elliptic.P256()
+	case "P-384":
+		return elliptic.P384()
+	case "P-521":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// findKey returns the local or external key with the given kid. Unknown kids refresh the external keys, as the
+// provider may have rotated them
+func (keySet *jwtKeySet) findKey(kid string) (key *jwtKey, external bool) {
+	keySet.mutex.RLock()
+	key, external = keySet.lookup(kid)
+	shouldRefresh := key == nil && len(keySet.sources) > 0 && time.Since(keySet.lastFetch) > jwksMinRefreshInterval
+	keySet.mutex.RUnlock()
+
+	if shouldRefresh {
+		err := keySet.fetchExternalKeys()
+		if err != nil {
+			log.Println("ERROR:", err)
+			return nil, false
+		}
+		keySet.mutex.RLock()
+		key, external = keySet.lookup(kid)
+		keySet.mutex.RUnlock()
+	}
+	return key, external
+}
+
+func (keySet *jwtKeySet) lookup(kid string) (*jwtKey, bool) {
+	if key, ok := keySet.local[kid]; ok {
+		return key, false
+	}
+	if key, ok := keySet.external[kid]; ok {
+		return key, true
+	}
+	return nil, false
+}
+
+// jwtKeyFunc returns the key to verify the token. HS256 tokens use JWT_SECRET, and the rest are looked up by kid
+func (app *WeStack) jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(app.jwtSecretKey) == 0 {
+			return nil, fmt.Errorf("HMAC tokens are not accepted without JWT_SECRET")
+		}
+		return app.jwtSecretKey, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		break
+	default:
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	if app.jwtKeys == nil {
+		return nil, fmt.Errorf("no keys configured for %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, external := app.jwtKeys.findKey(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown kid %v", kid)
+	}
+	if key.method != nil && key.method.Alg() != token.Method.Alg() {
+		return nil, fmt.Errorf("key %v does not use %v", kid, token.Method.Alg())
+	}
+	switch key.publicKey.(type) {
+	case *rsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("key %v is not an RSA key", kid)
+		}
+		break
+	case *ecdsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+			return nil, fmt.Errorf("key %v is not an EC key", kid)
+		}
+		break
+	}
+	if external {
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if !ok {
+			return nil, fmt.Errorf("unexpected claims for key %v", kid)
+		}
+		if key.source.Issuer != "" && !claims.VerifyIssuer(key.source.Issuer, true) {
+			return nil, fmt.Errorf("unexpected issuer for key %v", kid)
+		}
+		if !claims.VerifyAudience(key.source.Audience, true) {
+			return nil, fmt.Errorf("unexpected audience for key %v", kid)
+		}
+		restrictExternalClaims(claims, key.source)
+	}
+	return key.publicKey, nil
+}
+
+/*
+restrictExternalClaims removes the claims that only this app can grant from the claims of an external token, before
+GetBearer reads them:
+  - userId and mfa are removed, so the user id is the sub claim
+  - roles only keeps the local roles granted with mapRoles of the jwks source, or is removed
+*/
+func restrictExternalClaims(claims jwt.MapClaims, source *jwksSourceConfig) {
+	externalRoles, _ := claims["roles"].([]interface{})
+	delete(claims, "userId")
+	delete(claims, "mfa")
+	delete(claims, "roles")
+	var roles []interface{}
+	for _, externalRole := range externalRoles {
+		roleName, ok := externalRole.(string)
+		if !ok {
+			continue
+		}
+		for _, mapping := range source.MapRoles {
+			if mapping.From == roleName {
+				roles = append(roles, mapping.To)
+			}
+		}
+	}
+	if len(roles) > 0 {
+		claims["roles"] = roles
+	}
+}
+
+// isExternalToken reports whether the token was signed by an external identity provider
+func (app *WeStack) isExternalToken(token *jwt.Token) bool {
+	if app.jwtKeys == nil {
+		return false
+	}
+	if _, isHMAC := token.Method.(*jwt.SigningMethodHMAC); isHMAC {
+		return false
+	}
+	kid, _ := token.Header["kid"].(string)
+	_, external := app.jwtKeys.findKey(kid)
+	return external
+}
+
+// jwksHandler serves the public keys of jwt.keys, so other services can verify the tokens issued by this app
+func jwksHandler(app *WeStack) func(ctx *fiber.Ctx) error {
+	return func(ctx *fiber.Ctx) error {
+		keys := make([]jsonWebKey, 0)
+		if app.jwtKeys != nil {
+			for _, key := range app.jwtKeys.local {
+				keys = append(keys, toJsonWebKey(key))
+			}
+		}
+		ctx.Set(fiber.HeaderCacheControl, "public, max-age=300")
+		return ctx.JSON(fiber.Map{"keys": keys})
+	}
+}
+
+func toJsonWebKey(key *jwtKey) jsonWebKey {
+	jwk := jsonWebKey{Kid: key.kid, Use: "sig", Alg: key.method.Alg()}
+	switch publicKey := key.publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		break
+	case *ecdsa.PublicKey:
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = publicKey.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(publicKey.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(publicKey.Y.FillBytes(make([]byte, size)))
+		break
+	}
+	return jwk
+}
@@ -0,0 +1,149 @@
+package westack
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+const realmField = "realm"
+
+// Fields that identify a user at login when the model does not set "login.fields"
+var defaultLoginFields = []string{"email", "username"}
+
+func loginFields(loadedModel *model.Model) []string {
+	if len(loadedModel.Config.Login.Fields) > 0 {
+		return loadedModel.Config.Login.Fields
+	}
+	return defaultLoginFields
+}
+
+// realmOf returns the realm in data, or nil if the model does not use realms or data has none
+func realmOf(loadedModel *model.Model, data wst.M) interface{} {
+	if !loadedModel.Config.Login.Realms {
+		return nil
+	}
+	if realm, ok := data[realmField].(string); ok && strings.TrimSpace(realm) != "" {
+		return realm
+	}
+	return nil
+}
+
+/*
+identifierWhere returns the condition to find the user with value in field. With "login.caseInsensitive", the value
+is compared ignoring case, and with "login.realms" only the users of the same realm are considered
+*/
+func identifierWhere(loadedModel *model.Model, field string, value string, realm interface{}) wst.Where {
+	where := wst.Where{}
+	if loadedModel.Config.Login.CaseInsensitive {
+		where[field] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}
+	} else {
+		where[field] = value
+	}
+	if loadedModel.Config.Login.Realms {
+		where[realmField] = realm
+	}
+	return where
+}
+
+// findByIdentifier returns the user with value in field, or nil if there is none
+func findByIdentifier(loadedModel *model.Model, field string, value string, realm interface{}) (*model.Instance, error) {
+	where := identifierWhere(loadedModel, field, value, realm)
+	return loadedModel.FindOne(&wst.Filter{Where: &where}, systemContext())
+}
+
+// checkIdentifiersUniqueness rejects data if another user of the same realm has the same email or username. ownId is
+// the id of the user being updated, or nil for new users
+func checkIdentifiersUniqueness(loadedModel *model.Model, data wst.M, ownId interface{}) error {
+	realm := realmOf(loadedModel, data)
+	for _, field := range uniqueFields(loadedModel) {
+		value, _ := data[field].(string)
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		existent, err := findByIdentifier(loadedModel, field, value, realm)
+		if err != nil {
+			return err
+		}
+		if existent != nil && (ownId == nil || model.GetIDAsString(existent.Id) != model.GetIDAsString(ownId)) {
+			if field == "email" {
+				return wst.CreateError(fiber.ErrConflict, "EMAIL_UNIQUENESS", fiber.Map{"message": fmt.Sprintf("The `user` instance is not valid. Details: `email` Email already exists (value: \"%v\").", value), "codes": wst.M{"email": []string{"uniqueness"}}}, "ValidationError")
+			}
+			if field == "username" {
+				return wst.CreateError(fiber.ErrConflict, "USERNAME_UNIQUENESS", fiber.Map{"message": fmt.Sprintf("The `user` instance is not valid. Details: `username` User already exists (value: \"%v\").", value), "codes": wst.M{"username": []string{"uniqueness"}}}, "ValidationError")
+			}
+			return wst.CreateError(fiber.ErrConflict, strings.ToUpper(field)+"_UNIQUENESS", fiber.Map{"message": fmt.Sprintf("The `user` instance is not valid. Details: `%v` already exists (value: \"%v\").", field, value), "codes": wst.M{field: []string{"uniqueness"}}}, "ValidationError")
+		}
+	}
+	return nil
+}
+
+// updatedIdentifiers returns the unique fields written by the update data, also with $set, together with the realm of
+// the user. It returns nil if the update does not write any of them
+func updatedIdentifiers(loadedModel *model.Model, data wst.M, previousValues wst.M) wst.M {
+	written := wst.M{}
+	for key, value := range data {
+		written[key] = value
+	}
+	if set, ok := data["$set"].(map[string]interface{}); ok {
+		for key, value := range set {
+			written[key] = value
+		}
+	} else if set, ok := data["$set"].(wst.M); ok {
+		for key, value := range set {
+			written[key] = value
+		}
+	}
+	identifiers := wst.M{}
+	for _, field := range uniqueFields(loadedModel) {
+		if value, ok := written[field]; ok {
+			identifiers[field] = value
+		}
+	}
+	if len(identifiers) == 0 {
+		return nil
+	}
+	if realm, ok := written[realmField]; ok {
+		identifiers[realmField] = realm
+	} else {
+		identifiers[realmField] = previousValues[realmField]
+	}
+	return identifiers
+}
+
+// uniqueFields returns email, username and the login fields of the model
+func uniqueFields(loadedModel *model.Model) []string {
+	fields := []string{"email", "username"}
+	for _, field := range loadedModel.Config.Login.Fields {
+		if field != "email" && field != "username" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// loginIdentifier returns the first login field present in data, and its value
+func loginIdentifier(loadedModel *model.Model, data wst.M) (string, string) {
+	for _, field := range loginFields(loadedModel) {
+		value, _ := data[field].(string)
+		if strings.TrimSpace(value) != "" {
+			return field, value
+		}
+	}
+	return "", ""
+}
+
+// findLoginUser returns the user identified by the first login field present in data, or nil if there is none
+func findLoginUser(loadedModel *model.Model, data wst.M) (*model.Instance, error) {
+	field, value := loginIdentifier(loadedModel, data)
+	if field == "" {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "USERNAME_EMAIL_REQUIRED", fiber.Map{"message": fmt.Sprintf("%v is required", strings.Join(loginFields(loadedModel), " or "))}, "ValidationError")
+	}
+	return findByIdentifier(loadedModel, field, value, realmOf(loadedModel, data))
+}
@@ -0,0 +1,360 @@
+package westack
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+const (
+	defaultMaxLoginAttempts      = 5
+	defaultMaxLoginAttemptsPerIp = 20
+	defaultLoginAttemptsWindow   = 15 * time.Minute
+	defaultLoginLockout          = time.Minute
+	defaultMaxLoginLockout       = time.Hour
+)
+
+// Every key of an account or ip has three entries in the store: the failures within the window, the lockouts, and
+// the end of the current lockout
+const (
+	failuresSuffix    = ":failures"
+	lockoutsSuffix    = ":lockouts"
+	lockedUntilSuffix = ":lockedUntil"
+)
+
+// Interval between the sweeps of the expired entries of the memory store
+const memoryLoginAttemptsSweep = time.Minute
+
+type loginAttemptStore interface {
+	// increment adds one to the counter key and returns the new value. The counter expires ttl after the first increment
+	increment(key string, ttl time.Duration) (int64, error)
+	lock(key string, until time.Time) error
+	lockedUntil(key string) (time.Time, error)
+	delete(keys ...string) error
+}
+
+/*
+loginProtection counts the failed logins per account and per ip. After maxAttempts failures within the window, the
+account or ip is locked for lockout, doubling on every new lockout up to maxLockout. It is configured in config.json:
+
+	"loginProtection": {
+	  "maxAttempts": 5,
+	  "maxAttemptsPerIp": 20,
+	  "window": 900,
+	  "lockout": 60,
+	  "maxLockout": 3600,
+	  "datasource": "redis"
+	}
+
+Times are in seconds. Without datasource, the counters are kept in memory, so each instance of the app keeps its own
+*/
+type loginProtection struct {
+	disabled         bool
+	maxAttempts      int
+	maxAttemptsPerIp int
+	window           time.Duration
+	lockout          time.Duration
+	maxLockout       time.Duration
+	store            loginAttemptStore
+}
+
+func (app *WeStack) loadLoginProtection() {
+	protection := &loginProtection{
+		disabled:         app.viper.GetBool("loginProtection.disabled"),
+		maxAttempts:      defaultMaxLoginAttempts,
+		maxAttemptsPerIp: defaultMaxLoginAttemptsPerIp,
+		window:           defaultLoginAttemptsWindow,
+		lockout:          defaultLoginLockout,
+		maxLockout:       defaultMaxLoginLockout,
+	}
+	if value := app.viper.GetInt("loginProtection.maxAttempts"); value > 0 {
+		protection.maxAttempts = value
+	}
+	if value := app.viper.GetInt("loginProtection.maxAttemptsPerIp"); value > 0 {
+		protection.maxAttemptsPerIp = value
+	}
+	if value := app.viper.GetInt64("loginProtection.window"); value > 0 {
+		protection.window = time.Duration(value) * time.Second
+	}
+	if value := app.viper.GetInt64("loginProtection.lockout"); value > 0 {
+		protection.lockout = time.Duration(value) * time.Second
+	}
+	if value := app.viper.GetInt64("loginProtection.maxLockout"); value > 0 {
+		protection.maxLockout = time.Duration(value) * time.Second
+	}
+
+	if dsName := app.viper.GetString("loginProtection.datasource"); dsName != "" {
+		ds := (*app.datasources)[dsName]
+		if ds == nil {
+			panic(fmt.Sprintf("ERROR: Missing loginProtection datasource %v", dsName))
+		}
+		rClient, ok := ds.Db.(*redis.Client)
+		if !ok {
+			panic(fmt.Sprintf("ERROR: loginProtection datasource %v must use the redis connector", dsName))
+		}
+		protection.store = &redisLoginAttemptStore{ds: rClient, prefix: ds.Viper.GetString(ds.Key + ".database")}
+	} else {
+		protection.store = newMemoryLoginAttemptStore(memoryLoginAttemptsSweep)
+	}
+	app.loginProtection = protection
+}
+
+func accountAttemptsKey(loadedModel *model.Model, data wst.M) string {
+	field, value := loginIdentifier(loadedModel, data)
+	key := fmt.Sprintf("login:account:%v:%v:%v", loadedModel.Name, field, strings.ToLower(strings.TrimSpace(value)))
+	if realm := realmOf(loadedModel, data); realm != nil {
+		key += fmt.Sprintf(":%v", realm)
+	}
+	return key
+}
+
+func ipAttemptsKey(ip string) string {
+	return "login:ip:" + ip
+}
+
+// checkLocked returns a LOGIN_LOCKED error, and sets the Retry-After header, if the account or the ip are locked
+func (protection *loginProtection) checkLocked(ctx *fiber.Ctx, keys ...string) error {
+	if protection.disabled {
+		return nil
+	}
+	var lockedUntil time.Time
+	for _, key := range keys {
+		keyLockedUntil, err := protection.store.lockedUntil(key + lockedUntilSuffix)
+		if err != nil {
+			return err
+		}
+		if keyLockedUntil.After(lockedUntil) {
+			lockedUntil = keyLockedUntil
+		}
+	}
+	if !lockedUntil.After(time.Now()) {
+		return nil
+	}
+	return lockedError(ctx, lockedUntil)
+}
+
+func lockedError(ctx *fiber.Ctx, lockedUntil time.Time) error {
+	retryAfter := int64(math.Ceil(time.Until(lockedUntil).Seconds()))
+	ctx.Set(fiber.HeaderRetryAfter, fmt.Sprintf("%v", retryAfter))
+	return wst.CreateError(fiber.ErrTooManyRequests, "LOGIN_LOCKED", fiber.Map{"message": fmt.Sprintf("Too many failed logins, try again in %v seconds", retryAfter), "retryAfter": retryAfter}, "Error")
+}
+
+// recordFailure counts a failed login for key, and returns the end of the lockout if this failure starts one. The
+// counters are incremented atomically, so concurrent failures cannot exceed maxAttempts without a lockout
+func (protection *loginProtection) recordFailure(key string, maxAttempts int) (time.Time, error) {
+	if protection.disabled {
+		return time.Time{}, nil
+	}
+	failures, err := protection.store.increment(key+failuresSuffix, protection.window)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// Only the failure that reaches maxAttempts starts the lockout, and the next window starts after it
+	if failures != int64(maxAttempts) {
+		return time.Time{}, nil
+	}
+	err = protection.store.delete(key + failuresSuffix)
+	if err != nil {
+		return time.Time{}, err
+	}
+	lockouts, err := protection.store.increment(key+lockoutsSuffix, protection.window+protection.maxLockout)
+	if err != nil {
+		return time.Time{}, err
+	}
+	lockout := time.Duration(float64(protection.lockout) * math.Pow(2, float64(lockouts-1)))
+	if lockout > protection.maxLockout || lockout <= 0 {
+		lockout = protection.maxLockout
+	}
+	lockedUntil := time.Now().Add(lockout)
+	return lockedUntil, protection.store.lock(key+lockedUntilSuffix, lockedUntil)
+}
+
+// recordSuccess forgets the failures and lockouts of the account
+func (protection *loginProtection) recordSuccess(key string) error {
+	if protection.disabled {
+		return nil
+	}
+	return protection.store.delete(key+failuresSuffix, key+lockoutsSuffix)
+}
+
+// resetFailures forgets the failures of the ip, but not its lockouts
+func (protection *loginProtection) resetFailures(key string) error {
+	if protection.disabled {
+		return nil
+	}
+	return protection.store.delete(key + failuresSuffix)
+}
+
+/*
+checkLoginAttempt wraps the login of data: it rejects it while the account or the ip are locked, and records the
+result of login. When an account gets locked, the loginLocked handler of the model is invoked with the user as
+Instance and {"lockedUntil", "ip"} as Data, so the user can be notified
+*/
+func (app *WeStack) checkLoginAttempt(loadedModel *model.Model, ctx *model.EventContext, login func() (*model.Instance, error)) error {
+	protection := app.loginProtection
+	accountKey := accountAttemptsKey(loadedModel, *ctx.Data)
+	ipKey := ipAttemptsKey(ctx.Ctx.IP())
+	err := protection.checkLocked(ctx.Ctx, accountKey, ipKey)
+	if err != nil {
+		return err
+	}
+
+	user, loginErr := login()
+	if loginErr == nil {
+		err = protection.recordSuccess(accountKey)
+		if err != nil {
+			return err
+		}
+		return protection.resetFailures(ipKey)
+	}
+	if errorCode(loginErr) != "LOGIN_FAILED" {
+		return loginErr
+	}
+
+	_, err = protection.recordFailure(ipKey, protection.maxAttemptsPerIp)
+	if err != nil {
+		return err
+	}
+	lockedUntil, err := protection.recordFailure(accountKey, protection.maxAttempts)
+	if err != nil {
+		return err
+	}
+	if !lockedUntil.IsZero() && user != nil && loadedModel.HasHandler("loginLocked") {
+		err = loadedModel.GetHandler("loginLocked")(&model.EventContext{
+			BaseContext: ctx,
+			Ctx:         ctx.Ctx,
+			Instance:    user,
+			Data:        &wst.M{"lockedUntil": lockedUntil, "ip": ctx.Ctx.IP()},
+		})
+		if err != nil {
+			log.Println("ERROR: loginLocked:", err)
+		}
+	}
+	return loginErr
+}
+
+func errorCode(err error) string {
+	if westackError, ok := err.(*wst.WeStackError); ok {
+		return westackError.Code
+	}
+	return ""
+}
+
+type memoryLoginAttempts struct {
+	count       int64
+	lockedUntil time.Time
+	expiresAt   time.Time
+}
+
+type memoryLoginAttemptStore struct {
+	entries map[string]memoryLoginAttempts
+	mutex   sync.Mutex
+}
+
+// newMemoryLoginAttemptStore returns a store that removes the expired entries every sweepInterval, so the map does not
+// grow with every ip that ever failed a login
+func newMemoryLoginAttemptStore(sweepInterval time.Duration) *memoryLoginAttemptStore {
+	store := &memoryLoginAttemptStore{entries: map[string]memoryLoginAttempts{}}
+	ticker := time.NewTicker(sweepInterval)
+	go func() {
+		for now := range ticker.C {
+			store.mutex.Lock()
+			for key, entry := range store.entries {
+				if entry.expiresAt.Before(now) {
+					delete(store.entries, key)
+				}
+			}
+			store.mutex.Unlock()
+		}
+	}()
+	return store
+}
+
+func (store *memoryLoginAttemptStore) increment(key string, ttl time.Duration) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	entry, ok := store.entries[key]
+	if !ok || entry.expiresAt.Before(now) {
+		entry = memoryLoginAttempts{expiresAt: now.Add(ttl)}
+	}
+	entry.count++
+	store.entries[key] = entry
+	return entry.count, nil
+}
+
+func (store *memoryLoginAttemptStore) lock(key string, until time.Time) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.entries[key] = memoryLoginAttempts{lockedUntil: until, expiresAt: until}
+	return nil
+}
+
+func (store *memoryLoginAttemptStore) lockedUntil(key string) (time.Time, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	entry, ok := store.entries[key]
+	if !ok || entry.expiresAt.Before(time.Now()) {
+		return time.Time{}, nil
+	}
+	return entry.lockedUntil, nil
+}
+
+func (store *memoryLoginAttemptStore) delete(keys ...string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, key := range keys {
+		delete(store.entries, key)
+	}
+	return nil
+}
+
+type redisLoginAttemptStore struct {
+	ds     *redis.Client
+	prefix string
+}
+
+// INCR and PEXPIRE in one step, so a counter never stays without expiration
+var redisIncrementScript = redis.NewScript(`
+local value = redis.call("INCR", KEYS[1])
+if value == 1 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return value
+`)
+
+func (store *redisLoginAttemptStore) increment(key string, ttl time.Duration) (int64, error) {
+	return redisIncrementScript.Run(store.ds.Context(), store.ds, []string{store.prefix + ":" + key}, ttl.Milliseconds()).Int64()
+}
+
+func (store *redisLoginAttemptStore) lock(key string, until time.Time) error {
+	return store.ds.Set(store.ds.Context(), store.prefix+":"+key, until.UnixMilli(), time.Until(until)).Err()
+}
+
+func (store *redisLoginAttemptStore) lockedUntil(key string) (time.Time, error) {
+	value, err := store.ds.Get(store.ds.Context(), store.prefix+":"+key).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(value), nil
+}
+
+func (store *redisLoginAttemptStore) delete(keys ...string) error {
+	prefixedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		prefixedKeys[i] = store.prefix + ":" + key
+	}
+	return store.ds.Del(store.ds.Context(), prefixedKeys...).Err()
+}
@@ -0,0 +1,132 @@
+package westack
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+const mailTemplatesDirectory = "./common/templates"
+
+// Templates used when common/templates does not have a file with the same name
+var defaultMailTemplates = map[string]string{
+	"verify-email": `{{define "subject"}}Verify your email{{end}}<p>Hello,</p>
+<p>Please verify your email by opening this link:</p>
+<p><a href="{{.link}}">{{.link}}</a></p>`,
+	"reset-password": `{{define "subject"}}Reset your password{{end}}<p>Hello,</p>
+<p>Somebody asked to reset the password of your account. If it was you, open this link to choose a new one:</p>
+<p><a href="{{.link}}">{{.link}}</a></p>
+<p>Otherwise you can ignore this email.</p>`,
+}
+
+// loadMailTemplates parses the html templates in common/templates. Each file is a template named after the file
+// without the extension, and can define the subject with {{define "subject"}}...{{end}}
+func (app *WeStack) loadMailTemplates() {
+	app.mailTemplates = map[string]*template.Template{}
+	for name, text := range defaultMailTemplates {
+		app.mailTemplates[name] = template.Must(template.New(name).Parse(text))
+	}
+
+	fileInfos, err := ioutil.ReadDir(mailTemplatesDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		panic(err)
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() || filepath.Ext(fileInfo.Name()) != ".html" {
+			continue
+		}
+		name := strings.TrimSuffix(fileInfo.Name(), ".html")
+		tmpl, err := template.ParseFiles(filepath.Join(mailTemplatesDirectory, fileInfo.Name()))
+		if err != nil {
+			panic(fmt.Errorf("invalid mail template %v: %w", fileInfo.Name(), err))
+		}
+		app.mailTemplates[name] = tmpl
+	}
+}
+
+// mailDatasource returns the datasource mail.datasource of config.json, or the first one with the "mail" connector
+func (app *WeStack) mailDatasource() *datasource.Datasource {
+	if dsName := app.viper.GetString("mail.datasource"); dsName != "" {
+		ds := (*app.datasources)[dsName]
+		if ds == nil {
+			panic(fmt.Sprintf("ERROR: Missing mail datasource %v", dsName))
+		}
+		return ds
+	}
+	for _, ds := range *app.datasources {
+		if ds.Viper.GetString(ds.Key+".connector") == "mail" {
+			return ds
+		}
+	}
+	return nil
+}
+
+// SendTemplateMail renders the template common/templates/<templateName>.html with data, and sends it with the mail
+// datasource
+func (app *WeStack) SendTemplateMail(templateName string, to []string, data interface{}) error {
+	ds := app.mailDatasource()
+	if ds == nil {
+		return fmt.Errorf("there is no datasource with the mail connector")
+	}
+	tmpl := app.mailTemplates[templateName]
+	if tmpl == nil {
+		return fmt.Errorf("mail template %v not found", templateName)
+	}
+	var html bytes.Buffer
+	err := tmpl.Execute(&html, data)
+	if err != nil {
+		return err
+	}
+	subject := ""
+	if subjectTemplate := tmpl.Lookup("subject"); subjectTemplate != nil {
+		var subjectBuffer bytes.Buffer
+		err = subjectTemplate.Execute(&subjectBuffer, data)
+		if err != nil {
+			return err
+		}
+		subject = strings.TrimSpace(subjectBuffer.String())
+	}
+	return ds.SendMail(datasource.Mail{
+		To:      to,
+		Subject: subject,
+		Html:    strings.TrimSpace(html.String()),
+	})
+}
+
+// sendVerificationMail is the default sendVerificationEmail handler when there is a mail datasource
+func (app *WeStack) sendVerificationMail(ctx *model.EventContext) error {
+	data := *ctx.Data
+	email := data.GetString("email")
+	ctx.Instance.HideProperties()
+	return app.SendTemplateMail("verify-email", []string{email}, map[string]interface{}{
+		"email": email,
+		"link":  data["link"],
+		"user":  ctx.Instance.ToJSON(),
+	})
+}
+
+// sendResetPasswordMail is the default sendResetPasswordEmail handler when there is a mail datasource
+func (app *WeStack) sendResetPasswordMail(ctx *model.EventContext) error {
+	data := *ctx.Data
+	email := data.GetString("email")
+	ctx.Instance.HideProperties()
+	if app.debug {
+		log.Println("Send reset password email to", email)
+	}
+	return app.SendTemplateMail("reset-password", []string{email}, map[string]interface{}{
+		"email": email,
+		"link":  data["link"],
+		"user":  ctx.Instance.ToJSON(),
+	})
+}
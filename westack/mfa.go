@@ -0,0 +1,383 @@
+package westack
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+const (
+	mfaField           = "mfa"
+	mfaChallengeTtl    = 5 * time.Minute
+	totpPeriod         = 30
+	totpDigits         = 6
+	recoveryCodesCount = 10
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the RFC 6238 code of the secret for the time step counter, using HMAC-SHA1
+func totpCode(secret []byte, counter uint64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTotp returns the time step matched by code, accepting one step of clock drift. Steps up to lastCounter were
+// already used and are rejected, so a code cannot be replayed
+func verifyTotp(encodedSecret string, code string, lastCounter int64) (int64, bool) {
+	secret, err := base32NoPadding.DecodeString(strings.ToUpper(encodedSecret))
+	code = strings.TrimSpace(code)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := time.Now().Unix() / totpPeriod
+	for counter := current - 1; counter <= current+1; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(secret, uint64(counter))), []byte(code)) {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+func randomBase32(size int) (string, error) {
+	raw := make([]byte, size)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(raw), nil
+}
+
+// generateRecoveryCodes returns the codes to show to the user once, and their bcrypt hashes to store
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodesCount)
+	hashes := make([]string, recoveryCodesCount)
+	for idx := range codes {
+		raw, err := randomBase32(10)
+		if err != nil {
+			return nil, nil, err
+		}
+		raw = strings.ToLower(raw)
+		codes[idx] = raw[:8] + "-" + raw[8:]
+		hashed, err := bcrypt.GenerateFromPassword([]byte(codes[idx]), 10)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[idx] = string(hashed)
+	}
+	return codes, hashes, nil
+}
+
+func mfaOf(user *model.Instance) wst.M {
+	if mfa := user.GetM(mfaField); mfa != nil {
+		return *mfa
+	}
+	return wst.M{}
+}
+
+func mfaEnabled(user *model.Instance) bool {
+	return user.GetBoolean(mfaField+".enabled", false)
+}
+
+func toStrings(value interface{}) []string {
+	var result []string
+	switch value.(type) {
+	case []string:
+		return value.([]string)
+	case primitive.A:
+		value = []interface{}(value.(primitive.A))
+	}
+	if values, ok := value.([]interface{}); ok {
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+func invalidMfaCodeError() error {
+	return wst.CreateError(fiber.ErrUnauthorized, "INVALID_MFA_CODE", fiber.Map{"message": "invalid code"}, "Error")
+}
+
+func saveMfa(user *model.Instance, mfa wst.M) error {
+	_, err := user.UpdateAttributes(wst.M{mfaField: mfa}, &model.EventContext{BaseContext: systemContext(), SkipFieldProtection: true})
+	return err
+}
+
+/*
+checkMfaCode accepts a current TOTP code, or one of the recovery codes of the user. Recovery codes, and the time steps
+of TOTP codes, are consumed so they cannot be used twice. They are consumed with a conditional update, so only one of
+concurrent requests with the same code succeeds
+*/
+func checkMfaCode(user *model.Instance, code string, recoveryCode string) error {
+	mfa := mfaOf(user)
+	secret, _ := mfa["secret"].(string)
+	if !mfaEnabled(user) || secret == "" {
+		return wst.CreateError(fiber.ErrBadRequest, "MFA_NOT_ENABLED", fiber.Map{"message": "MFA is not enabled"}, "Error")
+	}
+	if strings.TrimSpace(recoveryCode) != "" {
+		hashes := toStrings(mfa["recoveryCodes"])
+		for _, hashed := range hashes {
+			if bcrypt.CompareHashAndPassword([]byte(hashed), []byte(strings.ToLower(strings.TrimSpace(recoveryCode)))) == nil {
+				return consumeMfa(user, wst.M{mfaField + ".recoveryCodes": hashed}, wst.M{"$pull": wst.M{mfaField + ".recoveryCodes": hashed}})
+			}
+		}
+		return invalidMfaCodeError()
+	}
+	counter, ok := verifyTotp(secret, code, user.GetInt(mfaField+".lastCounter"))
+	if !ok {
+		return invalidMfaCodeError()
+	}
+	return consumeMfa(user, wst.M{mfaField + ".lastCounter": wst.M{"$lt": counter}}, wst.M{"$set": wst.M{mfaField + ".lastCounter": counter}})
+}
+
+// consumeMfa applies update to the user if it still matches condition, and rejects the code otherwise
+func consumeMfa(user *model.Instance, condition wst.M, update wst.M) error {
+	filter := wst.M{"_id": user.Id}
+	for key, value := range condition {
+		filter[key] = value
+	}
+	matchedCount, err := user.Model.Datasource.UpdateOne(user.Model.CollectionName, filter, update)
+	if err != nil {
+		return err
+	}
+	if matchedCount == 0 {
+		return invalidMfaCodeError()
+	}
+	return nil
+}
+
+/*
+mfaSetup starts the enrollment of the current user: it creates a secret and returns it with its otpauth:// uri, to be
+shown as a QR code. MFA is not enabled until a code of the secret is sent to POST /<users>/mfa/verify. The issuer in
+the uri is mfa.issuer of config.json, or the name of the app
+*/
+func (app *WeStack) mfaSetup(loadedModel *model.Model, ctx *model.EventContext) (fiber.Map, error) {
+	user, err := app.currentUser(loadedModel, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if mfaEnabled(user) {
+		return nil, wst.CreateError(fiber.ErrConflict, "MFA_ALREADY_ENABLED", fiber.Map{"message": "MFA is already enabled"}, "Error")
+	}
+	secret, err := randomBase32(20)
+	if err != nil {
+		return nil, err
+	}
+	err = saveMfa(user, wst.M{"enabled": false, "pendingSecret": secret})
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := app.viper.GetString("mfa.issuer")
+	if issuer == "" {
+		issuer = app.viper.GetString("name")
+	}
+	account := user.GetString("email")
+	if account == "" {
+		account = user.GetString("username")
+	}
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprintf("%v", totpDigits)},
+		"period":    {fmt.Sprintf("%v", totpPeriod)},
+	}
+	uri := "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode()
+	return fiber.Map{"secret": secret, "uri": uri}, nil
+}
+
+// mfaVerify enables MFA for the current user with a code of the secret from mfaSetup, and returns the recovery codes.
+// They are shown only once: only their hashes are stored
+func (app *WeStack) mfaVerify(loadedModel *model.Model, ctx *model.EventContext) (fiber.Map, error) {
+	code, _ := (*ctx.Data)["code"].(string)
+	user, err := app.currentUser(loadedModel, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if mfaEnabled(user) {
+		return nil, wst.CreateError(fiber.ErrConflict, "MFA_ALREADY_ENABLED", fiber.Map{"message": "MFA is already enabled"}, "Error")
+	}
+	pendingSecret, _ := mfaOf(user)["pendingSecret"].(string)
+	if pendingSecret == "" {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "MFA_SETUP_REQUIRED", fiber.Map{"message": "call mfa/setup first"}, "Error")
+	}
+	counter, ok := verifyTotp(pendingSecret, code, 0)
+	if !ok {
+		return nil, invalidMfaCodeError()
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = saveMfa(user, wst.M{"enabled": true, "secret": pendingSecret, "lastCounter": counter, "recoveryCodes": hashes})
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{"recoveryCodes": codes}, nil
+}
+
+// mfaDisable disables MFA for the current user, after checking the password and a code or recovery code
+func (app *WeStack) mfaDisable(loadedModel *model.Model, ctx *model.EventContext) error {
+	data := *ctx.Data
+	password, _ := data["password"].(string)
+	code, _ := data["code"].(string)
+	recoveryCode, _ := data["recoveryCode"].(string)
+	user, err := app.currentUser(loadedModel, ctx)
+	if err != nil {
+		return err
+	}
+	err = checkPassword(user, password)
+	if err != nil {
+		return err
+	}
+	err = checkMfaCode(user, code, recoveryCode)
+	if err != nil {
+		return err
+	}
+	return saveMfa(user, wst.M{"enabled": false})
+}
+
+/*
+completeLogin finishes a login whose first factor was checked. Users without MFA get their tokens. Users with MFA get
+a challenge token instead, valid for 5 minutes, to send with a code to POST /<users>/login/mfa:
+
+	{"mfaRequired": true, "challengeToken": "...", "ttl": 300}
+*/
+func (app *WeStack) completeLogin(user *model.Instance, ctx *model.EventContext) (fiber.Map, error) {
+	userId := user.Id.(primitive.ObjectID)
+	if !mfaEnabled(user) {
+		roleNames, err := app.findUserRoles(userId)
+		if err != nil {
+			return nil, err
+		}
+		return app.issueTokens(user, roleNames, "", false, ctx)
+	}
+
+	expiresAt := time.Now().Add(mfaChallengeTtl)
+	jti := uuid.New().String()
+	challengeToken, err := app.signToken(jwt.MapClaims{
+		"userId": userId.Hex(),
+		"type":   "mfa_challenge",
+		"jti":    jti,
+		"exp":    expiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = app.storeToken(wst.M{"userId": userId}, "mfa_challenge", jti, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{"mfaRequired": true, "challengeToken": challengeToken, "ttl": int64(mfaChallengeTtl.Seconds())}, nil
+}
+
+/*
+loginMfa completes a login with its challenge token and a TOTP code, or a recovery code. The access token carries the
+"mfa" claim, required by models with "requireMfa" in their casbin config. Wrong codes count as failed logins of the
+user, so they are locked like in POST /<users>/login
+*/
+func (app *WeStack) loginMfa(loadedModel *model.Model, ctx *model.EventContext) (fiber.Map, error) {
+	invalidTokenErr := wst.CreateError(fiber.ErrUnauthorized, "INVALID_MFA_CHALLENGE", fiber.Map{"message": "invalid or expired challenge token"}, "Error")
+
+	data := *ctx.Data
+	rawToken, _ := data["challengeToken"].(string)
+	code, _ := data["code"].(string)
+	recoveryCode, _ := data["recoveryCode"].(string)
+	claims, err := app.parseToken(rawToken)
+	if err != nil || claims["type"] != "mfa_challenge" {
+		return nil, invalidTokenErr
+	}
+	userIdHex, _ := claims["userId"].(string)
+	userId, err := primitive.ObjectIDFromHex(userIdHex)
+	if err != nil {
+		return nil, invalidTokenErr
+	}
+	storedTokens, err := app.accessTokenModel.FindMany(&wst.Filter{Where: &wst.Where{"jti": claims["jti"], "type": "mfa_challenge"}}, systemContext())
+	if err != nil {
+		return nil, err
+	}
+	if len(storedTokens) == 0 {
+		return nil, invalidTokenErr
+	}
+	user, err := loadedModel.FindById(userId, nil, systemContext())
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, invalidTokenErr
+	}
+
+	protection := app.loginProtection
+	attemptsKey := fmt.Sprintf("login:mfa:%v:%v", loadedModel.Name, userIdHex)
+	err = protection.checkLocked(ctx.Ctx, attemptsKey)
+	if err != nil {
+		return nil, err
+	}
+	err = checkMfaCode(user, code, recoveryCode)
+	if err != nil {
+		if errorCode(err) == "INVALID_MFA_CODE" {
+			_, recordErr := protection.recordFailure(attemptsKey, protection.maxAttempts)
+			if recordErr != nil {
+				return nil, recordErr
+			}
+		}
+		return nil, err
+	}
+	err = protection.recordSuccess(attemptsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Challenge tokens are valid only once
+	storedToken, err := app.claimStoredToken(claims["jti"], "mfa_challenge")
+	if err != nil {
+		return nil, err
+	}
+	if storedToken == nil {
+		return nil, invalidTokenErr
+	}
+	ctx.Instance = user
+	roleNames, err := app.findUserRoles(userId)
+	if err != nil {
+		return nil, err
+	}
+	return app.issueTokens(user, roleNames, "", true, ctx)
+}
+
+// hideMfa adds the MFA settings to the hidden properties of a User model
+func hideMfa(config *model.Config) {
+	for _, propertyName := range config.Hidden {
+		if propertyName == mfaField {
+			return
+		}
+	}
+	config.Hidden = append(config.Hidden, mfaField)
+}
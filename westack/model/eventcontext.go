@@ -1,9 +1,9 @@
 package model
 
 import (
-	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt"
@@ -26,7 +26,36 @@ type EventContext struct {
 	ModelID                interface{}
 	StatusCode             int
 	DisableTypeConversions bool
-	SkipFieldProtection    bool
+	// Lets Create and UpdateAttributes write the fields that the before save hooks protect, like the password of User
+	// models. Only for Go code, after checking that the change is allowed
+	SkipFieldProtection bool
+	// Values of the instance before an update. Nil when creating
+	PreviousValues *wst.M
+	// Set by WeStack.Transaction(). Every operation run with this context, or a context derived from it, is part of it
+	Transaction *Transaction
+	// Instances deleted by the current DeleteById or Purge and its cascades, so cycles of relations stop there
+	deletedInstances map[string]bool
+}
+
+// Changes returns the properties of Data whose value differs from PreviousValues. When creating, it returns all of them.
+// Update operators like $inc are not included
+func (eventContext *EventContext) Changes() wst.M {
+	changes := wst.M{}
+	if eventContext.Data == nil {
+		return changes
+	}
+	for key, value := range *eventContext.Data {
+		if key == "id" || key == "_id" || isUpdateOperator(key) {
+			continue
+		}
+		if eventContext.PreviousValues != nil {
+			if previousValue, exists := (*eventContext.PreviousValues)[key]; exists && valuesEqual(previousValue, value) {
+				continue
+			}
+		}
+		changes[key] = value
+	}
+	return changes
 }
 
 func (eventContext *EventContext) UpdateEphemeral(newData *wst.M) {
@@ -64,29 +93,28 @@ func (eventContext *EventContext) GetBearer(loadedModel *Model) (error, *BearerT
 
 		rawToken = authBearerPair[1]
 
-		token, err := jwt.Parse(rawToken, func(token *jwt.Token) (interface{}, error) {
-
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-
-			return loadedModel.App.JwtSecretKey, nil
-		})
+		token, err := jwt.Parse(rawToken, loadedModel.App.JwtKeyFunc)
 
 		if token != nil {
-			if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+			if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid && isAccessTokenClaims(claims) && isActiveToken(loadedModel.App, token) {
 				bearerClaims = claims
 				claimRoles := claims["roles"]
 				userId := claims["userId"]
+				if userId == nil {
+					// Tokens of external identity providers
+					userId = claims["sub"]
+				}
 				user = &BearerUser{
 					Id:   userId,
 					Data: claims,
 				}
-				if claimRoles != nil {
-					for _, role := range claimRoles.([]interface{}) {
-						roles = append(roles, BearerRole{
-							Name: role.(string),
-						})
+				if claimRoles, ok := claimRoles.([]interface{}); ok {
+					for _, role := range claimRoles {
+						if roleName, ok := role.(string); ok {
+							roles = append(roles, BearerRole{
+								Name: roleName,
+							})
+						}
 					}
 				}
 			} else {
@@ -103,3 +131,32 @@ func (eventContext *EventContext) GetBearer(loadedModel *Model) (error, *BearerT
 	}
 
 }
+
+// isActiveToken asks the app whether the token was revoked, when tokens are persisted
+func isActiveToken(app *wst.IApp, token *jwt.Token) bool {
+	if app == nil || app.IsTokenActive == nil {
+		return true
+	}
+	active, err := app.IsTokenActive(token)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return active
+}
+
+// isAccessTokenClaims rejects tokens issued for other purposes, like refresh tokens, and tokens without the exp claim
+// whose created + ttl is in the past. The exp claim is already checked by jwt.Parse
+func isAccessTokenClaims(claims jwt.MapClaims) bool {
+	if tokenType, _ := claims["type"].(string); tokenType != "" && tokenType != "access" {
+		return false
+	}
+	if _, hasExp := claims["exp"]; !hasExp {
+		created, hasCreated := toFloat64(claims["created"])
+		ttl, hasTtl := toFloat64(claims["ttl"])
+		if !hasCreated || !hasTtl || created+ttl < float64(time.Now().UnixMilli()) {
+			return false
+		}
+	}
+	return true
+}
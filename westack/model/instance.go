@@ -159,14 +159,34 @@ func (modelInstance *Instance) UpdateAttributes(data interface{}, baseContext *E
 	if !baseContext.DisableTypeConversions {
 		datasource.ReplaceObjectIds(finalData)
 	}
+	err := modelInstance.Model.normalizeGeoPoints(finalData)
+	if err != nil {
+		return nil, err
+	}
+	err = modelInstance.checkUpdateOperators(finalData, targetBaseContext)
+	if err != nil {
+		return nil, err
+	}
+	var expectedVersion int64
+	if modelInstance.Model.Config.Versioned {
+		expectedVersion, err = modelInstance.expectedVersion(finalData, targetBaseContext)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	eventContext := &EventContext{
-		BaseContext: targetBaseContext,
+		BaseContext:         targetBaseContext,
+		SkipFieldProtection: baseContext.SkipFieldProtection,
+		Transaction:         transactionOf(baseContext),
 	}
+	previousValues := modelInstance.ToJSON()
 	eventContext.Data = &finalData
+	eventContext.PreviousValues = &previousValues
 	eventContext.Instance = modelInstance
 	eventContext.ModelID = modelInstance.Id
 	eventContext.IsNewInstance = false
+	_, modifiedRequested := finalData["modified"]
 	if modelInstance.Model.DisabledHandlers["__operation__before_save"] != true {
 		err := modelInstance.Model.GetHandler("__operation__before_save")(eventContext)
 		if err != nil {
@@ -177,7 +197,32 @@ func (modelInstance *Instance) UpdateAttributes(data interface{}, baseContext *E
 	for key := range *modelInstance.Model.Config.Relations {
 		delete(finalData, key)
 	}
-	document, err := modelInstance.Model.Datasource.UpdateById(modelInstance.Model.CollectionName, modelInstance.Id, &finalData)
+	// Only the properties that changed are written, together with the update operators
+	changes := eventContext.Changes()
+	for key, value := range finalData {
+		if isUpdateOperator(key) {
+			changes[key] = value
+		}
+	}
+	if _, ok := changes["modified"]; ok && len(changes) == 1 && !modifiedRequested {
+		// Only the date stamped by the before save hook changed
+		delete(changes, "modified")
+	}
+	if len(changes) == 0 {
+		// Nothing to write, the version is not incremented and no audit record or after save hook runs either
+		modelInstance.HideProperties()
+		return modelInstance, nil
+	}
+	ds, err := modelInstance.Model.datasourceFor(eventContext)
+	if err != nil {
+		return nil, err
+	}
+	var document *wst.M
+	if modelInstance.Model.Config.Versioned {
+		document, err = modelInstance.updateVersioned(ds, changes, expectedVersion)
+	} else {
+		document, err = ds.UpdateById(modelInstance.Model.CollectionName, modelInstance.Id, &changes)
+	}
 
 	if err != nil {
 		return nil, err
@@ -192,6 +237,10 @@ func (modelInstance *Instance) UpdateAttributes(data interface{}, baseContext *E
 		eventContext.Instance = modelInstance
 		eventContext.ModelID = modelInstance.Id
 		eventContext.IsNewInstance = false
+		err = modelInstance.Model.recordAudit("update", modelInstance.Id, previousValues, modelInstance.ToJSON(), eventContext)
+		if err != nil {
+			return nil, err
+		}
 		if modelInstance.Model.DisabledHandlers["__operation__after_save"] != true {
 			err = modelInstance.Model.GetHandler("__operation__after_save")(eventContext)
 			if err != nil {
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,9 +24,11 @@ import (
 )
 
 type Property struct {
-	Type     interface{} `json:"type"`
-	Required bool        `json:"required"`
-	Default  interface{} `json:"default"`
+	Type            interface{} `json:"type"`
+	Required        bool        `json:"required"`
+	Default         interface{} `json:"default"`
+	TextIndex       bool        `json:"textIndex"`
+	UpdateOperators []string    `json:"updateOperators"`
 }
 
 type Relation struct {
@@ -35,7 +38,8 @@ type Relation struct {
 	ForeignKey *string `json:"foreignKey"`
 	Options    struct {
 		//Inverse bool `json:"inverse"`
-		SkipAuth bool `json:"skipAuth"`
+		SkipAuth bool   `json:"skipAuth"`
+		OnDelete string `json:"onDelete"`
 	} `json:"options"`
 }
 
@@ -54,6 +58,8 @@ type CasbinConfig struct {
 	PolicyEffect       string   `json:"policyEffect"`
 	MatchersDefinition string   `json:"matchersDefinition"`
 	Policies           []string `json:"policies"`
+	// RequireMfa rejects the bearers that did not log in with a second factor
+	RequireMfa bool `json:"requireMfa"`
 }
 
 type CacheConfig struct {
@@ -62,22 +68,37 @@ type CacheConfig struct {
 	Keys       [][]string `json:"keys"`
 }
 
+// LoginConfig sets how User models identify users at login
+type LoginConfig struct {
+	// Fields accepted as identifier, in order. Defaults to email and username
+	Fields          []string `json:"fields"`
+	CaseInsensitive bool     `json:"caseInsensitive"`
+	// Realms scopes the identifiers by the "realm" field, so separate pools of users can share a collection
+	Realms bool `json:"realms"`
+}
+
 type MongoConfig struct {
 	//Database string `json:"database"`
 	Collection string `json:"collection"`
 }
 
 type Config struct {
-	Name       string                `json:"name"`
-	Plural     string                `json:"plural"`
-	Base       string                `json:"base"`
-	Public     bool                  `json:"public"`
-	Properties map[string]Property   `json:"properties"`
-	Relations  *map[string]*Relation `json:"relations"`
-	Hidden     []string              `json:"hidden"`
-	Casbin     CasbinConfig          `json:"casbin"`
-	Cache      CacheConfig           `json:"cache"`
-	Mongo      MongoConfig           `json:"mongo"`
+	Name         string                `json:"name"`
+	Plural       string                `json:"plural"`
+	Base         string                `json:"base"`
+	Public       bool                  `json:"public"`
+	Properties   map[string]Property   `json:"properties"`
+	Relations    *map[string]*Relation `json:"relations"`
+	Hidden       []string              `json:"hidden"`
+	Casbin       CasbinConfig          `json:"casbin"`
+	Cache        CacheConfig           `json:"cache"`
+	Mongo        MongoConfig           `json:"mongo"`
+	Scopes       map[string]wst.Filter `json:"scopes"`
+	DefaultScope *wst.Filter           `json:"defaultScope"`
+	SoftDelete   bool                  `json:"softDelete"`
+	Versioned    bool                  `json:"versioned"`
+	Audit        bool                  `json:"audit"`
+	Login        LoginConfig           `json:"login"`
 }
 
 type SimplifiedConfig struct {
@@ -106,6 +127,7 @@ type Model struct {
 	CasbinAdapter    **fileadapter.Adapter
 	Enforcer         *casbin.Enforcer
 	DisabledHandlers map[string]bool
+	AuditModel       *Model `json:"-"`
 
 	eventHandlers    map[string]func(eventContext *EventContext) error
 	modelRegistry    *map[string]*Model
@@ -240,7 +262,32 @@ func ParseFilter(filter string) *wst.Filter {
 	return filterMap
 }
 
+// prepareFilter applies the default scope and resolves the parts of filterMap that cannot be translated directly to a
+// pipeline, like conditions on related models and geospatial operators
+func (loadedModel *Model) prepareFilter(filterMap *wst.Filter, baseContext *EventContext) (*wst.Filter, error) {
+	if loadedModel.Config.DefaultScope != nil && !isSystemContext(baseContext) {
+		filterMap = MergeFilters(loadedModel.Config.DefaultScope, filterMap)
+	}
+	if loadedModel.Config.SoftDelete {
+		filterMap = MergeFilters(&wst.Filter{Where: &wst.Where{softDeleteField: nil}}, filterMap)
+	}
+	err := validateRecursiveIncludes(filterMap)
+	if err != nil {
+		return nil, err
+	}
+	filterMap, err = loadedModel.resolveRelatedFilter(filterMap, baseContext)
+	if err != nil {
+		return nil, err
+	}
+	return loadedModel.resolveGeoFilter(filterMap)
+}
+
 func (loadedModel *Model) FindMany(filterMap *wst.Filter, baseContext *EventContext) (InstanceA, error) {
+	return loadedModel.findMany(filterMap, baseContext, nil)
+}
+
+// findMany is FindMany with extraStages appended to the pipeline built from filterMap, before the includes are resolved
+func (loadedModel *Model) findMany(filterMap *wst.Filter, baseContext *EventContext, extraStages wst.A) (InstanceA, error) {
 
 	if baseContext == nil {
 		baseContext = &EventContext{}
@@ -256,9 +303,24 @@ func (loadedModel *Model) FindMany(filterMap *wst.Filter, baseContext *EventCont
 		deepLevel++
 	}
 
+	filterMap, err := loadedModel.prepareFilter(filterMap, targetBaseContext)
+	if err != nil {
+		return nil, err
+	}
+
 	lookups := loadedModel.ExtractLookupsFromFilter(filterMap, baseContext.DisableTypeConversions)
+	if len(extraStages) > 0 {
+		if lookups == nil {
+			lookups = &wst.A{}
+		}
+		*lookups = append(*lookups, extraStages...)
+	}
 
-	documents, err := loadedModel.Datasource.FindMany(loadedModel.CollectionName, lookups)
+	ds, err := loadedModel.datasourceFor(baseContext)
+	if err != nil {
+		return nil, err
+	}
+	documents, err := ds.FindMany(loadedModel.CollectionName, lookups)
 	if err != nil {
 		return nil, err
 	}
@@ -374,6 +436,87 @@ func (loadedModel *Model) FindMany(filterMap *wst.Filter, baseContext *EventCont
 	return results, nil
 }
 
+// Number of documents buffered by FindEach before resolving their includes and building their instances
+const findEachBatchSize = 100
+
+// FindEach streams the results of filterMap to handler instead of loading all of them in memory like FindMany does.
+// Documents are read from the datasource cursor in batches of findEachBatchSize, so includes are still resolved per
+// batch. Results are never written to the model cache. Cancelling ctx stops reading the cursor; nil uses the context of
+// the datasource.
+func (loadedModel *Model) FindEach(ctx context.Context, filterMap *wst.Filter, baseContext *EventContext, handler func(instance *Instance) error) error {
+
+	if baseContext == nil {
+		baseContext = &EventContext{}
+	}
+	var targetBaseContext = baseContext
+	for {
+		if targetBaseContext.BaseContext != nil {
+			targetBaseContext = targetBaseContext.BaseContext
+		} else {
+			break
+		}
+	}
+
+	filterMap, err := loadedModel.prepareFilter(filterMap, targetBaseContext)
+	if err != nil {
+		return err
+	}
+
+	var targetInclude *wst.Include
+	if filterMap != nil && filterMap.Include != nil {
+		includeAsInterfaces := *filterMap.Include
+		targetInclude = &includeAsInterfaces
+		for _, includeItem := range *targetInclude {
+			relation := (*loadedModel.Config.Relations)[includeItem.Relation]
+			if relation == nil || (*loadedModel.modelRegistry)[relation.Model] == nil {
+				return errors.New("related model not found")
+			}
+		}
+	}
+
+	lookups := loadedModel.ExtractLookupsFromFilter(filterMap, baseContext.DisableTypeConversions)
+
+	batch := make(wst.A, 0, findEachBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if targetInclude != nil {
+			for _, includeItem := range *targetInclude {
+				err := loadedModel.mergeRelated(1, &batch, includeItem, targetBaseContext)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, document := range batch {
+			instance := loadedModel.Build(document, targetBaseContext)
+			err := handler(&instance)
+			if err != nil {
+				return err
+			}
+		}
+		batch = make(wst.A, 0, findEachBatchSize)
+		return nil
+	}
+
+	ds, err := loadedModel.datasourceFor(baseContext)
+	if err != nil {
+		return err
+	}
+	err = ds.FindEach(ctx, loadedModel.CollectionName, lookups, func(document wst.M) error {
+		batch = append(batch, document)
+		if len(batch) >= findEachBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
 func (loadedModel *Model) FindOne(filterMap *wst.Filter, baseContext *EventContext) (*Instance, error) {
 
 	if filterMap == nil {
@@ -477,9 +620,15 @@ func (loadedModel *Model) Create(data interface{}, baseContext *EventContext) (*
 	if !baseContext.DisableTypeConversions {
 		datasource.ReplaceObjectIds(finalData)
 	}
+	err := loadedModel.normalizeGeoPoints(finalData)
+	if err != nil {
+		return nil, err
+	}
 
 	eventContext := &EventContext{
-		BaseContext: targetBaseContext,
+		BaseContext:         targetBaseContext,
+		SkipFieldProtection: baseContext.SkipFieldProtection,
+		Transaction:         transactionOf(baseContext),
 	}
 	eventContext.Data = &finalData
 	eventContext.IsNewInstance = true
@@ -492,7 +641,14 @@ func (loadedModel *Model) Create(data interface{}, baseContext *EventContext) (*
 	for key := range *loadedModel.Config.Relations {
 		delete(finalData, key)
 	}
-	document, err := loadedModel.Datasource.Create(loadedModel.CollectionName, &finalData)
+	if loadedModel.Config.Versioned {
+		finalData[versionField] = 1
+	}
+	ds, err := loadedModel.datasourceFor(eventContext)
+	if err != nil {
+		return nil, err
+	}
+	document, err := ds.Create(loadedModel.CollectionName, &finalData)
 
 	if err != nil {
 		return nil, err
@@ -502,6 +658,10 @@ func (loadedModel *Model) Create(data interface{}, baseContext *EventContext) (*
 		result := loadedModel.Build(*document, eventContext)
 		result.HideProperties()
 		eventContext.Instance = &result
+		err = loadedModel.recordAudit("create", result.Id, nil, result.ToJSON(), eventContext)
+		if err != nil {
+			return nil, err
+		}
 		if loadedModel.DisabledHandlers["__operation__after_save"] != true {
 			err := loadedModel.GetHandler("__operation__after_save")(eventContext)
 			if err != nil {
@@ -513,8 +673,65 @@ func (loadedModel *Model) Create(data interface{}, baseContext *EventContext) (*
 
 }
 
-func (loadedModel *Model) DeleteById(id interface{}) (int64, error) {
+func (loadedModel *Model) DeleteById(id interface{}, baseContext *EventContext) (int64, error) {
+
+	finalId := loadedModel.documentId(id, "DeleteById")
+
+	eventContext := loadedModel.deleteEventContext(finalId, baseContext)
+	return loadedModel.inCascadeTransaction(eventContext, func() (int64, error) {
+		return loadedModel.deleteById(finalId, eventContext)
+	})
+}
+
+func (loadedModel *Model) deleteById(finalId interface{}, eventContext *EventContext) (int64, error) {
+	err := loadedModel.runDeleteHook("__operation__before_delete", eventContext)
+	if err != nil {
+		return 0, err
+	}
 
+	var before wst.M
+	if loadedModel.Config.Audit {
+		instance, err := loadedModel.FindById(finalId, nil, eventContext)
+		if err != nil {
+			return 0, err
+		}
+		before = instance.ToJSON()
+	}
+
+	ds, err := loadedModel.datasourceFor(eventContext)
+	if err != nil {
+		return 0, err
+	}
+	var deletedCount int64
+	if loadedModel.Config.SoftDelete {
+		matchedCount, err := ds.UpdateOne(loadedModel.CollectionName, wst.M{"_id": finalId, softDeleteField: nil}, wst.M{"$set": wst.M{softDeleteField: time.Now()}})
+		if err != nil {
+			return 0, err
+		}
+		deletedCount = matchedCount
+	} else {
+		deletedCount = ds.DeleteById(loadedModel.CollectionName, finalId)
+	}
+	if deletedCount == 0 {
+		return 0, datasource.NewError(fiber.StatusNotFound, "Document not found")
+	}
+
+	err = loadedModel.recordAudit("delete", finalId, before, nil, eventContext)
+	if err != nil {
+		return 0, err
+	}
+	err = loadedModel.deleteRelated(finalId, eventContext)
+	if err != nil {
+		return 0, err
+	}
+	err = loadedModel.runDeleteHook("__operation__after_delete", eventContext)
+	if err != nil {
+		return 0, err
+	}
+	return deletedCount, nil
+}
+
+func (loadedModel *Model) documentId(id interface{}, operation string) interface{} {
 	var finalId interface{}
 	switch id.(type) {
 	case string:
@@ -532,16 +749,10 @@ func (loadedModel *Model) DeleteById(id interface{}) (int64, error) {
 		break
 	default:
 		if loadedModel.App.Debug {
-			log.Println(fmt.Sprintf("WARNING: Invalid input for Model.DeleteById() <- %s", id))
+			log.Println(fmt.Sprintf("WARNING: Invalid input for Model.%v() <- %s", operation, id))
 		}
 	}
-	//TODO: Invoke hook for __operation__before_delete and __operation__after_delete
-	deletedCount := loadedModel.Datasource.DeleteById(loadedModel.CollectionName, finalId)
-	if deletedCount > 0 {
-		return deletedCount, nil
-	} else {
-		return 0, datasource.NewError(fiber.StatusNotFound, "Document not found")
-	}
+	return finalId
 }
 
 type RemoteMethodOptionsHttp struct {
@@ -623,6 +834,11 @@ func (loadedModel *Model) Observe(operation string, handler func(eventContext *E
 	loadedModel.On(eventKey, handler)
 }
 
+// HasHandler reports whether a handler was registered for the event with On()
+func (loadedModel *Model) HasHandler(event string) bool {
+	return loadedModel.eventHandlers[event] != nil
+}
+
 func (loadedModel *Model) GetHandler(event string) func(eventContext *EventContext) error {
 	res := loadedModel.eventHandlers[event]
 	if res == nil {
@@ -643,6 +859,32 @@ func (loadedModel *Model) Initialize() {
 	}
 }
 
+// EnsureIndexes creates the indexes required by the model properties: a text index over the properties marked with
+// "textIndex": true and a 2dsphere index for every geopoint property
+func (loadedModel *Model) EnsureIndexes() error {
+	textKeys := wst.M{}
+	for propertyName, property := range loadedModel.Config.Properties {
+		if property.TextIndex {
+			textKeys[propertyName] = "text"
+		}
+	}
+	if len(textKeys) > 0 {
+		err := loadedModel.Datasource.CreateIndex(loadedModel.CollectionName, textKeys, fmt.Sprintf("%v_text", loadedModel.CollectionName))
+		if err != nil {
+			return err
+		}
+	}
+	for propertyName, property := range loadedModel.Config.Properties {
+		if property.Type == geoPointType {
+			err := loadedModel.Datasource.CreateIndex(loadedModel.CollectionName, wst.M{propertyName: "2dsphere"}, fmt.Sprintf("%v_%v_2dsphere", loadedModel.CollectionName, propertyName))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func GetIDAsString(idToConvert interface{}) string {
 	foundObjUserId := idToConvert
 	switch idToConvert.(type) {
@@ -0,0 +1,153 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+// Formats used by $dateToString for each supported date bucket
+var dateBucketFormats = map[string]string{
+	"hour":  "%Y-%m-%dT%H:00:00Z",
+	"day":   "%Y-%m-%d",
+	"week":  "%G-W%V",
+	"month": "%Y-%m",
+	"year":  "%Y",
+}
+
+var aggregateOperators = map[string]string{
+	"sum": "$sum",
+	"avg": "$avg",
+	"min": "$min",
+	"max": "$max",
+}
+
+/*
+Aggregate groups the documents matching where and computes metrics for every group.
+
+params:
+  - groupBy: properties to group by. Date properties can be bucketed with a suffix: "created:day". Supported buckets
+    are hour, day, week, month and year
+  - metrics: "count", or "<operator>:<property>" where operator is one of sum, avg, min or max. The result of each
+    metric is returned as "<operator>_<property>"
+*/
+func (loadedModel *Model) Aggregate(where *wst.Where, groupBy []string, metrics []string, baseContext *EventContext) (wst.A, error) {
+
+	if baseContext == nil {
+		baseContext = &EventContext{}
+	}
+	var targetBaseContext = baseContext
+	for {
+		if targetBaseContext.BaseContext != nil {
+			targetBaseContext = targetBaseContext.BaseContext
+		} else {
+			break
+		}
+	}
+
+	if len(metrics) == 0 {
+		metrics = []string{"count"}
+	}
+
+	groupId := wst.M{}
+	project := wst.M{"_id": false}
+	for _, groupItem := range groupBy {
+		groupItem = strings.TrimSpace(groupItem)
+		if groupItem == "" {
+			continue
+		}
+		field, bucket := splitAggregateItem(groupItem)
+		if err := loadedModel.checkAggregateField(field); err != nil {
+			return nil, err
+		}
+		alias := aggregateAlias(field)
+		if bucket == "" {
+			groupId[alias] = fmt.Sprintf("$%v", field)
+		} else {
+			format, ok := dateBucketFormats[bucket]
+			if !ok {
+				return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_GROUP_BY", fiber.Map{"message": fmt.Sprintf("Invalid date bucket %v for %v", bucket, field)}, "ValidationError")
+			}
+			groupId[alias] = wst.M{"$dateToString": wst.M{"format": format, "date": fmt.Sprintf("$%v", field)}}
+		}
+		project[alias] = fmt.Sprintf("$_id.%v", alias)
+	}
+
+	group := wst.M{"_id": groupId}
+	for _, metric := range metrics {
+		metric = strings.TrimSpace(metric)
+		if metric == "" {
+			continue
+		}
+		if metric == "count" {
+			group["count"] = wst.M{"$sum": 1}
+			project["count"] = true
+			continue
+		}
+		operatorName, field := splitAggregateItem(metric)
+		operator, ok := aggregateOperators[operatorName]
+		if !ok || field == "" {
+			return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_METRIC", fiber.Map{"message": fmt.Sprintf("Invalid metric %v", metric)}, "ValidationError")
+		}
+		if err := loadedModel.checkAggregateField(field); err != nil {
+			return nil, err
+		}
+		alias := fmt.Sprintf("%v_%v", operatorName, aggregateAlias(field))
+		group[alias] = wst.M{operator: fmt.Sprintf("$%v", field)}
+		project[alias] = true
+	}
+
+	filterMap, err := loadedModel.prepareFilter(&wst.Filter{Where: where}, targetBaseContext)
+	if err != nil {
+		return nil, err
+	}
+	// Only the where of the default scope applies to the documents being grouped
+	filterMap = &wst.Filter{Where: filterMap.Where}
+	lookups := loadedModel.ExtractLookupsFromFilter(filterMap, baseContext.DisableTypeConversions)
+
+	sortByGroup := wst.M{}
+	for alias := range groupId {
+		sortByGroup[alias] = 1
+	}
+	*lookups = append(*lookups, wst.M{"$group": group}, wst.M{"$project": project})
+	if len(sortByGroup) > 0 {
+		*lookups = append(*lookups, wst.M{"$sort": sortByGroup})
+	}
+
+	ds, err := loadedModel.datasourceFor(baseContext)
+	if err != nil {
+		return nil, err
+	}
+	documents, err := ds.FindMany(loadedModel.CollectionName, lookups)
+	if err != nil {
+		return nil, err
+	}
+	if documents == nil {
+		return wst.A{}, nil
+	}
+	return *documents, nil
+}
+
+func (loadedModel *Model) checkAggregateField(field string) error {
+	if loadedModel.isHiddenProperty(field) {
+		return wst.CreateError(fiber.ErrBadRequest, "INVALID_PROPERTY", fiber.Map{"message": fmt.Sprintf("Cannot aggregate by hidden property %v", field)}, "ValidationError")
+	}
+	return nil
+}
+
+// splitAggregateItem splits "sum:amount" or "created:day" in its two parts
+func splitAggregateItem(item string) (string, string) {
+	parts := strings.SplitN(item, ":", 2)
+	if len(parts) == 1 {
+		return strings.TrimSpace(parts[0]), ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// aggregateAlias returns a name for field that can be used as a key in $group
+func aggregateAlias(field string) string {
+	return strings.ReplaceAll(field, ".", "_")
+}
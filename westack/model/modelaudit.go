@@ -0,0 +1,111 @@
+package model
+
+import (
+	"bytes"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+// Name of the model used to store the history of models with "audit": true, unless config.json sets audit.model
+const DefaultAuditModelName = "AuditLog"
+
+/*
+recordAudit stores a history record for a model with "audit": true. Records contain:
+  - model, modelId and action (create, update, delete, restore or purge)
+  - diff: {"<property>": {"from": <before>, "to": <after>}}, without hidden properties
+  - userId of the bearer, timestamp and requestId (from the X-Request-Id header, or a new uuid)
+*/
+func (loadedModel *Model) recordAudit(action string, modelId interface{}, before wst.M, after wst.M, baseContext *EventContext) error {
+	if !loadedModel.Config.Audit || loadedModel.AuditModel == nil {
+		return nil
+	}
+
+	var targetBaseContext = baseContext
+	if targetBaseContext == nil {
+		targetBaseContext = &EventContext{}
+	}
+	for {
+		if targetBaseContext.BaseContext != nil {
+			targetBaseContext = targetBaseContext.BaseContext
+		} else {
+			break
+		}
+	}
+
+	var userId interface{}
+	if targetBaseContext.Bearer != nil && targetBaseContext.Bearer.User != nil {
+		userId = targetBaseContext.Bearer.User.Id
+	}
+	requestId := ""
+	if targetBaseContext.Ctx != nil {
+		requestId = targetBaseContext.Ctx.Get("X-Request-Id")
+	}
+	if requestId == "" {
+		requestId = uuid.New().String()
+	}
+
+	_, err := loadedModel.AuditModel.Create(wst.M{
+		"model":     loadedModel.Name,
+		"modelId":   modelId,
+		"action":    action,
+		"diff":      loadedModel.diff(before, after),
+		"userId":    userId,
+		"timestamp": time.Now(),
+		"requestId": requestId,
+	}, &EventContext{BaseContext: targetBaseContext, Transaction: transactionOf(baseContext)})
+	if err != nil {
+		log.Printf("ERROR: Could not write audit record for %v %v: %v\n", loadedModel.Name, modelId, err)
+	}
+	return err
+}
+
+// diff returns the properties that changed between before and after. Hidden properties and relations are skipped.
+func (loadedModel *Model) diff(before wst.M, after wst.M) wst.M {
+	skipped := map[string]bool{"id": true, "_id": true}
+	for _, propertyName := range loadedModel.Config.Hidden {
+		skipped[propertyName] = true
+	}
+	for relationName := range *loadedModel.Config.Relations {
+		skipped[relationName] = true
+	}
+
+	result := wst.M{}
+	for key, value := range after {
+		if !skipped[key] && !valuesEqual(before[key], value) {
+			result[key] = wst.M{"from": before[key], "to": value}
+		}
+	}
+	for key, value := range before {
+		if _, exists := after[key]; !exists && !skipped[key] {
+			result[key] = wst.M{"from": value, "to": nil}
+		}
+	}
+	return result
+}
+
+// valuesEqual compares the BSON representation of both values, so a time.Time and the primitive.DateTime read back
+// from the database are equal
+func valuesEqual(a interface{}, b interface{}) bool {
+	aBytes, errA := bson.Marshal(wst.M{"v": a})
+	bBytes, errB := bson.Marshal(wst.M{"v": b})
+	if errA != nil || errB != nil {
+		return false
+	}
+	return bytes.Equal(aBytes, bBytes)
+}
+
+// History returns the audit records of the instance, newest first
+func (loadedModel *Model) History(id interface{}, baseContext *EventContext) (InstanceA, error) {
+	if loadedModel.AuditModel == nil {
+		return InstanceA{}, nil
+	}
+	return loadedModel.AuditModel.FindMany(&wst.Filter{
+		Where: &wst.Where{"model": loadedModel.Name, "modelId": loadedModel.documentId(id, "History")},
+		Order: &wst.Order{"timestamp DESC"},
+	}, baseContext)
+}
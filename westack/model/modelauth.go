@@ -5,6 +5,8 @@ import (
 	"log"
 
 	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/westack/common"
 )
 
 func (loadedModel *Model) EnforceEx(token *BearerToken, objId string, action string, eventContext *EventContext) (error, bool) {
@@ -13,6 +15,10 @@ func (loadedModel *Model) EnforceEx(token *BearerToken, objId string, action str
 		return nil, true
 	}
 
+	if loadedModel.Config.Casbin.RequireMfa && token != nil && token.User != nil && token.Claims["mfa"] != true && !allowsWithoutMfa(action) {
+		return wst.CreateError(fiber.ErrForbidden, "MFA_REQUIRED", fiber.Map{"message": "log in with MFA to access " + loadedModel.Name}, "Error"), false
+	}
+
 	if token == nil {
 		log.Printf("WARNING: Trying to enforce without token at %v.%v\n", loadedModel.Name, action)
 	}
@@ -85,3 +91,13 @@ func (loadedModel *Model) EnforceEx(token *BearerToken, objId string, action str
 	}
 	return fiber.ErrUnauthorized, false
 }
+
+// allowsWithoutMfa reports whether the action is available to bearers without MFA on models that require it, so users
+// can enroll
+func allowsWithoutMfa(action string) bool {
+	switch action {
+	case "mfaSetup", "mfaVerify", "loginMfa", "logout":
+		return true
+	}
+	return false
+}
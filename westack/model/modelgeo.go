@@ -0,0 +1,288 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+const geoPointType = "geopoint"
+
+// Field added to the instances returned by a "near" query, with the distance in meters to the given point
+const distanceField = "_distance"
+
+func (loadedModel *Model) isGeoPoint(propertyName string) bool {
+	property, ok := loadedModel.Config.Properties[propertyName]
+	return ok && property.Type == geoPointType
+}
+
+// normalizeGeoPoints converts the geopoint properties in data to GeoJSON points. Accepted inputs are
+// {"lat": 40.4, "lng": -3.7}, [-3.7, 40.4] and GeoJSON points
+func (loadedModel *Model) normalizeGeoPoints(data wst.M) error {
+	for propertyName, value := range data {
+		if value == nil || !loadedModel.isGeoPoint(propertyName) {
+			continue
+		}
+		point, err := toGeoJSONPoint(value)
+		if err != nil {
+			return wst.CreateError(fiber.ErrBadRequest, "INVALID_GEOPOINT", fiber.Map{"message": fmt.Sprintf("Invalid geopoint %v: %v", propertyName, err)}, "ValidationError")
+		}
+		data[propertyName] = point
+	}
+	return nil
+}
+
+func toGeoJSONPoint(value interface{}) (wst.M, error) {
+	var lng, lat float64
+	var ok bool
+	switch value.(type) {
+	case wst.M, map[string]interface{}, primitive.M:
+		asMap := toM(value)
+		if asMap["type"] == "Point" {
+			return toGeoJSONPoint(asMap["coordinates"])
+		}
+		lat, ok = toFloat64(asMap["lat"])
+		if !ok {
+			return nil, fmt.Errorf("lat must be a number")
+		}
+		lng, ok = toFloat64(asMap["lng"])
+		if !ok {
+			return nil, fmt.Errorf("lng must be a number")
+		}
+		break
+	case []interface{}, primitive.A, []float64:
+		var items []interface{}
+		switch value.(type) {
+		case []interface{}:
+			items = value.([]interface{})
+		case primitive.A:
+			items = value.(primitive.A)
+		case []float64:
+			for _, item := range value.([]float64) {
+				items = append(items, item)
+			}
+		}
+		if len(items) != 2 {
+			return nil, fmt.Errorf("expected [lng, lat]")
+		}
+		lng, ok = toFloat64(items[0])
+		if !ok {
+			return nil, fmt.Errorf("lng must be a number")
+		}
+		lat, ok = toFloat64(items[1])
+		if !ok {
+			return nil, fmt.Errorf("lat must be a number")
+		}
+		break
+	default:
+		return nil, fmt.Errorf("expected {lat, lng} or [lng, lat]")
+	}
+	if lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return nil, fmt.Errorf("coordinates out of range")
+	}
+	return wst.M{"type": "Point", "coordinates": []float64{lng, lat}}, nil
+}
+
+/*
+resolveGeoFilter converts the geospatial operators of the where clause:
+  - {"location": {"near": {"lat": 40.4, "lng": -3.7}, "maxDistance": 1000, "minDistance": 0}} is normalized here and
+    becomes a $geoNear stage in ExtractLookupsFromFilter. Distances are in meters
+  - {"location": {"within": {"polygon": [[lng, lat], ...]}}} and {"location": {"within": {"box": [[lng, lat], [lng, lat]]}}}
+    become $geoWithin
+*/
+func (loadedModel *Model) resolveGeoFilter(filterMap *wst.Filter) (*wst.Filter, error) {
+	if filterMap == nil || filterMap.Where == nil {
+		return filterMap, nil
+	}
+	nearCount := 0
+	resolvedWhere, err := loadedModel.resolveGeoWhere(wst.M(*filterMap.Where), true, &nearCount)
+	if err != nil {
+		return nil, err
+	}
+	if nearCount > 0 && filterMap.Search != "" {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_WHERE", fiber.Map{"message": "near cannot be combined with a full-text search"}, "ValidationError")
+	}
+	filterCopy := *filterMap
+	asWhere := wst.Where(resolvedWhere)
+	filterCopy.Where = &asWhere
+	return &filterCopy, nil
+}
+
+func (loadedModel *Model) resolveGeoWhere(where wst.M, isRoot bool, nearCount *int) (wst.M, error) {
+	result := wst.M{}
+	for key, value := range where {
+		if isLogicalOperator(key) {
+			items := whereItems(value)
+			resolvedItems := make([]wst.M, len(items))
+			for idx, item := range items {
+				resolvedItem, err := loadedModel.resolveGeoWhere(item, false, nearCount)
+				if err != nil {
+					return nil, err
+				}
+				resolvedItems[idx] = resolvedItem
+			}
+			result[key] = resolvedItems
+			continue
+		}
+		condition := toM(value)
+		if !loadedModel.isGeoPoint(key) || condition == nil {
+			result[key] = value
+			continue
+		}
+		if condition["near"] != nil {
+			if !isRoot || *nearCount > 0 {
+				return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_WHERE", fiber.Map{"message": "near is only allowed once, at the root of the where clause"}, "ValidationError")
+			}
+			*nearCount++
+			point, err := toGeoJSONPoint(condition["near"])
+			if err != nil {
+				return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_WHERE", fiber.Map{"message": fmt.Sprintf("Invalid near for %v: %v", key, err)}, "ValidationError")
+			}
+			resolvedCondition := wst.M{"near": point}
+			for _, distanceKey := range []string{"maxDistance", "minDistance"} {
+				if condition[distanceKey] == nil {
+					continue
+				}
+				distance, ok := toFloat64(condition[distanceKey])
+				if !ok || distance < 0 {
+					return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_WHERE", fiber.Map{"message": fmt.Sprintf("Invalid %v for %v", distanceKey, key)}, "ValidationError")
+				}
+				resolvedCondition[distanceKey] = distance
+			}
+			result[key] = resolvedCondition
+		} else if condition["within"] != nil {
+			geometry, err := withinGeometry(toM(condition["within"]))
+			if err != nil {
+				return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_WHERE", fiber.Map{"message": fmt.Sprintf("Invalid within for %v: %v", key, err)}, "ValidationError")
+			}
+			result[key] = wst.M{"$geoWithin": wst.M{"$geometry": geometry}}
+		} else {
+			result[key] = value
+		}
+	}
+	return result, nil
+}
+
+// withinGeometry builds a GeoJSON polygon from {"polygon": [[lng, lat], ...]} or {"box": [[lng, lat], [lng, lat]]}
+func withinGeometry(within wst.M) (wst.M, error) {
+	var ring [][]float64
+	if within["polygon"] != nil {
+		points, err := toCoordinatesList(within["polygon"])
+		if err != nil {
+			return nil, err
+		}
+		if len(points) < 3 {
+			return nil, fmt.Errorf("a polygon needs at least 3 points")
+		}
+		ring = points
+	} else if within["box"] != nil {
+		corners, err := toCoordinatesList(within["box"])
+		if err != nil {
+			return nil, err
+		}
+		if len(corners) != 2 {
+			return nil, fmt.Errorf("a box needs 2 corners")
+		}
+		bottomLeft, topRight := corners[0], corners[1]
+		ring = [][]float64{
+			{bottomLeft[0], bottomLeft[1]},
+			{topRight[0], bottomLeft[1]},
+			{topRight[0], topRight[1]},
+			{bottomLeft[0], topRight[1]},
+		}
+	} else {
+		return nil, fmt.Errorf("expected polygon or box")
+	}
+	// GeoJSON rings must be closed
+	first, last := ring[0], ring[len(ring)-1]
+	if first[0] != last[0] || first[1] != last[1] {
+		ring = append(ring, []float64{first[0], first[1]})
+	}
+	return wst.M{"type": "Polygon", "coordinates": [][][]float64{ring}}, nil
+}
+
+func toCoordinatesList(value interface{}) ([][]float64, error) {
+	var items []interface{}
+	switch value.(type) {
+	case []interface{}:
+		items = value.([]interface{})
+	case primitive.A:
+		items = value.(primitive.A)
+	default:
+		return nil, fmt.Errorf("expected a list of points")
+	}
+	result := make([][]float64, len(items))
+	for idx, item := range items {
+		point, err := toGeoJSONPoint(item)
+		if err != nil {
+			return nil, err
+		}
+		result[idx] = point["coordinates"].([]float64)
+	}
+	return result, nil
+}
+
+// extractGeoNear removes the near condition, already normalized by resolveGeoFilter, from where and returns the
+// $geoNear stage that replaces the first $match
+func (loadedModel *Model) extractGeoNear(where wst.Where) (wst.M, wst.Where) {
+	for key, value := range where {
+		condition, ok := value.(wst.M)
+		if !ok || condition["near"] == nil || !loadedModel.isGeoPoint(key) {
+			continue
+		}
+		rest := wst.Where{}
+		for otherKey, otherValue := range where {
+			if otherKey != key {
+				rest[otherKey] = otherValue
+			}
+		}
+		geoNear := wst.M{
+			"near":          condition["near"],
+			"key":           key,
+			"distanceField": distanceField,
+			"spherical":     true,
+			"query":         rest,
+		}
+		if condition["maxDistance"] != nil {
+			geoNear["maxDistance"] = condition["maxDistance"]
+		}
+		if condition["minDistance"] != nil {
+			geoNear["minDistance"] = condition["minDistance"]
+		}
+		return wst.M{"$geoNear": geoNear}, rest
+	}
+	return nil, where
+}
+
+func toM(value interface{}) wst.M {
+	switch value.(type) {
+	case wst.M:
+		return value.(wst.M)
+	case map[string]interface{}:
+		return value.(map[string]interface{})
+	case primitive.M:
+		return wst.M(value.(primitive.M))
+	case wst.Where:
+		return wst.M(value.(wst.Where))
+	}
+	return nil
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch value.(type) {
+	case float64:
+		return value.(float64), true
+	case float32:
+		return float64(value.(float32)), true
+	case int:
+		return float64(value.(int)), true
+	case int32:
+		return float64(value.(int32)), true
+	case int64:
+		return float64(value.(int64)), true
+	}
+	return 0, false
+}
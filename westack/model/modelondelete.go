@@ -0,0 +1,129 @@
+package model
+
+import (
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+// Values of "onDelete" in the options of hasOne and hasMany relations
+const (
+	OnDeleteCascade   = "cascade"
+	OnDeleteAnonymize = "anonymize"
+)
+
+// ValidateOnDelete panics at boot if a relation has an unknown "onDelete" option, or uses it in a belongsTo relation
+func (loadedModel *Model) ValidateOnDelete() {
+	for relationName, relation := range *loadedModel.Config.Relations {
+		switch relation.Options.OnDelete {
+		case "":
+			continue
+		case OnDeleteCascade, OnDeleteAnonymize:
+			break
+		default:
+			panic(fmt.Sprintf("Invalid onDelete %#v in %v.%v, use %#v or %#v", relation.Options.OnDelete, loadedModel.Name, relationName, OnDeleteCascade, OnDeleteAnonymize))
+		}
+		if relation.Type != "hasOne" && relation.Type != "hasMany" {
+			panic(fmt.Sprintf("onDelete is only supported in hasOne and hasMany relations, found in %v.%v", loadedModel.Name, relationName))
+		}
+	}
+}
+
+/*
+deleteRelated applies the "onDelete" option of the hasOne and hasMany relations after deleting the instance id:
+  - cascade: the related instances are deleted too
+  - anonymize: the foreign key of the related instances is set to null
+
+baseContext must be the context built by deleteEventContext, instances already deleted by the same operation are skipped
+*/
+func (loadedModel *Model) deleteRelated(id interface{}, baseContext *EventContext) error {
+	for relationName, relation := range *loadedModel.Config.Relations {
+		if relation.Options.OnDelete == "" || relation.ForeignKey == nil {
+			continue
+		}
+		relatedModel := (*loadedModel.modelRegistry)[relation.Model]
+		if relatedModel == nil {
+			return fmt.Errorf("related model %v not found for relation %v.%v", relation.Model, loadedModel.Name, relationName)
+		}
+		foreignKey := *relation.ForeignKey
+		// Foreign keys may be stored as ObjectID or as their hex string
+		ids := []wst.M{{foreignKey: id}}
+		if objectId, ok := id.(primitive.ObjectID); ok {
+			ids = append(ids, wst.M{foreignKey: objectId.Hex()})
+		}
+		relatedInstances, err := relatedModel.FindMany(&wst.Filter{Where: &wst.Where{"$or": ids}}, &EventContext{
+			BaseContext:            baseContext,
+			DisableTypeConversions: true,
+		})
+		if err != nil {
+			return err
+		}
+		for _, relatedInstance := range relatedInstances {
+			if baseContext.deletedInstances[deletedInstanceKey(relatedModel, relatedInstance.Id)] {
+				// The relations lead back to an instance that is being deleted
+				continue
+			}
+			if relation.Options.OnDelete == OnDeleteCascade {
+				_, err = relatedModel.DeleteById(relatedInstance.Id, baseContext)
+			} else {
+				_, err = relatedInstance.UpdateAttributes(wst.M{foreignKey: nil}, baseContext)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func deletedInstanceKey(loadedModel *Model, id interface{}) string {
+	return fmt.Sprintf("%v/%v", loadedModel.Name, id)
+}
+
+// cascadeModels adds to models the model and every model reached through its "onDelete" options
+func (loadedModel *Model) cascadeModels(models map[string]*Model) {
+	models[loadedModel.Name] = loadedModel
+	for _, relation := range *loadedModel.Config.Relations {
+		if relation.Options.OnDelete == "" || relation.ForeignKey == nil {
+			continue
+		}
+		relatedModel := (*loadedModel.modelRegistry)[relation.Model]
+		if relatedModel != nil && models[relatedModel.Name] == nil {
+			relatedModel.cascadeModels(models)
+		}
+	}
+}
+
+// inCascadeTransaction runs operation in a new transaction when it applies "onDelete" options, eventContext is not
+// part of a transaction yet and every datasource involved supports them, so a failed cascade is not half applied
+func (loadedModel *Model) inCascadeTransaction(eventContext *EventContext, operation func() (int64, error)) (int64, error) {
+	if eventContext.Transaction != nil {
+		return operation()
+	}
+	models := map[string]*Model{}
+	loadedModel.cascadeModels(models)
+	cascades := false
+	for _, relation := range *loadedModel.Config.Relations {
+		cascades = cascades || (relation.Options.OnDelete != "" && relation.ForeignKey != nil)
+	}
+	if !cascades {
+		return operation()
+	}
+	for _, model := range models {
+		if !model.Datasource.SupportsTransactions() {
+			return operation()
+		}
+	}
+	eventContext.Transaction = NewTransaction()
+	deletedCount, err := operation()
+	if err != nil {
+		if abortErr := eventContext.Transaction.Abort(); abortErr != nil {
+			log.Println("ERROR: Could not abort transaction:", abortErr)
+		}
+		return 0, err
+	}
+	return deletedCount, eventContext.Transaction.Commit()
+}
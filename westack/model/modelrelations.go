@@ -1,8 +1,10 @@
 package model
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
@@ -44,18 +46,68 @@ func (loadedModel *Model) ExtractLookupsFromFilter(filterMap *wst.Filter, disabl
 	var targetSkip = filterMap.Skip
 	var targetLimit = filterMap.Limit
 
+	// Relations in the same datasource referenced by the where or order clauses, like "user.email"
+	var relatedFieldRelations []string
+	for _, relationName := range loadedModel.relationsInFilter(filterMap) {
+		relation := (*loadedModel.Config.Relations)[relationName]
+		relatedLoadedModel := (*loadedModel.modelRegistry)[relation.Model]
+		if relatedLoadedModel != nil && relatedLoadedModel.Datasource.Name == loadedModel.Datasource.Name {
+			relatedFieldRelations = append(relatedFieldRelations, relationName)
+		}
+	}
+
 	var lookups *wst.A
-	if targetWhere != nil {
-		if !disableTypeConversions {
-			datasource.ReplaceObjectIds(*targetWhere)
+	var relatedWhere wst.Where
+	var geoNear wst.M
+	if targetWhere != nil || filterMap.Search != "" {
+		rootWhere := wst.Where{}
+		if targetWhere != nil {
+			if !disableTypeConversions {
+				datasource.ReplaceObjectIds(*targetWhere)
+			}
+			rootWhere = *targetWhere
+			if len(relatedFieldRelations) > 0 {
+				rootWhere, relatedWhere = loadedModel.splitRelatedWhere(*targetWhere)
+			}
 		}
-		lookups = &wst.A{
-			{"$match": *targetWhere},
+		geoNear, rootWhere = loadedModel.extractGeoNear(rootWhere)
+		if filterMap.Search != "" {
+			// $text must be part of the first stage
+			searchWhere := wst.Where{}
+			for k, v := range rootWhere {
+				searchWhere[k] = v
+			}
+			searchWhere["$text"] = wst.M{"$search": filterMap.Search}
+			rootWhere = searchWhere
+		}
+		if geoNear != nil {
+			// $geoNear must be the first stage, it already includes the rest of the root where as its query
+			lookups = &wst.A{geoNear}
+		} else if len(rootWhere) > 0 || len(relatedFieldRelations) == 0 {
+			lookups = &wst.A{
+				{"$match": rootWhere},
+			}
+		} else {
+			lookups = &wst.A{}
 		}
 	} else {
 		lookups = &wst.A{}
 	}
 
+	if len(relatedFieldRelations) > 0 {
+		// Join the referenced relations before matching and sorting by their fields
+		for _, relationName := range relatedFieldRelations {
+			relation := (*loadedModel.Config.Relations)[relationName]
+			relatedLoadedModel := (*loadedModel.modelRegistry)[relation.Model]
+			*lookups = append(*lookups, loadedModel.relationLookupStages(relationName, relation, relatedLoadedModel, nil, disableTypeConversions)...)
+		}
+		if len(relatedWhere) > 0 {
+			*lookups = append(*lookups, wst.M{
+				"$match": relatedWhere,
+			})
+		}
+	}
+
 	if targetOrder != nil && len(*targetOrder) > 0 {
 		orderMap := wst.M{}
 		for _, orderPair := range *targetOrder {
@@ -73,6 +125,10 @@ func (loadedModel *Model) ExtractLookupsFromFilter(filterMap *wst.Filter, disabl
 		*lookups = append(*lookups, wst.M{
 			"$sort": orderMap,
 		})
+	} else if filterMap.Search != "" {
+		*lookups = append(*lookups, wst.M{
+			"$sort": wst.M{"score": wst.M{"$meta": "textScore"}},
+		})
 	}
 
 	if targetSkip > 0 {
@@ -93,6 +149,31 @@ func (loadedModel *Model) ExtractLookupsFromFilter(filterMap *wst.Filter, disabl
 	} else {
 		targetInclude = nil
 	}
+
+	if len(relatedFieldRelations) > 0 {
+		// Remove the relations that were only joined for filtering or sorting
+		project := wst.M{}
+		for _, relationName := range relatedFieldRelations {
+			included := false
+			if targetInclude != nil {
+				for _, includeItem := range *targetInclude {
+					if includeItem.Relation == relationName && reusesFilterLookup(includeItem) {
+						included = true
+						break
+					}
+				}
+			}
+			if !included {
+				project[relationName] = false
+			}
+		}
+		if len(project) > 0 {
+			*lookups = append(*lookups, wst.M{
+				"$project": project,
+			})
+		}
+	}
+
 	if targetInclude != nil {
 		for _, includeItem := range *targetInclude {
 
@@ -117,85 +198,579 @@ func (loadedModel *Model) ExtractLookupsFromFilter(filterMap *wst.Filter, disabl
 			}
 
 			if relatedLoadedModel.Datasource.Name == loadedModel.Datasource.Name {
-				switch relation.Type {
-				case "belongsTo", "hasOne", "hasMany":
-					var matching wst.M
-					var lookupLet wst.M
-					switch relation.Type {
-					case "belongsTo":
-						lookupLet = wst.M{
-							*relation.ForeignKey: fmt.Sprintf("$%v", *relation.ForeignKey),
-						}
-						matching = wst.M{
-							"$eq": []string{fmt.Sprintf("$%v", *relation.PrimaryKey), fmt.Sprintf("$$%v", *relation.ForeignKey)},
-						}
-						break
-					case "hasOne", "hasMany":
-						lookupLet = wst.M{
-							*relation.ForeignKey: fmt.Sprintf("$%v", *relation.PrimaryKey),
-						}
-						matching = wst.M{
-							"$eq": []string{fmt.Sprintf("$%v", *relation.ForeignKey), fmt.Sprintf("$$%v", *relation.ForeignKey)},
-						}
-						break
-					}
-					pipeline := []interface{}{
-						wst.M{
-							"$match": wst.M{
-								"$expr": wst.M{
-									"$and": wst.A{
-										matching,
-									},
-								},
-							},
+				if reusesFilterLookup(includeItem) && containsString(relatedFieldRelations, relationName) {
+					// Already joined to filter or sort by its fields
+					continue
+				}
+				if includeItem.Recursive && relatedLoadedModel == loadedModel {
+					*lookups = append(*lookups, loadedModel.recursiveLookupStage(relationName, relation, includeItem, disableTypeConversions))
+				} else {
+					*lookups = append(*lookups, loadedModel.relationLookupStages(relationName, relation, relatedLoadedModel, targetScope, disableTypeConversions)...)
+				}
+			}
+		}
+
+	} else {
+
+	}
+	return lookups
+}
+
+// reusesFilterLookup reports whether includeItem loads the same documents as the $lookup added to filter or sort by the
+// fields of its relation, so it does not need its own
+func reusesFilterLookup(includeItem wst.IncludeItem) bool {
+	return includeItem.Scope == nil && !includeItem.Recursive
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// relationLookupStages returns the $lookup stage that joins relationName from the same datasource, followed by an
+// $unwind stage for single relations
+func (loadedModel *Model) relationLookupStages(relationName string, relation *Relation, relatedLoadedModel *Model, targetScope *wst.Filter, disableTypeConversions bool) wst.A {
+	stages := wst.A{}
+	switch relation.Type {
+	case "belongsTo", "hasOne", "hasMany":
+		var matching wst.M
+		var lookupLet wst.M
+		switch relation.Type {
+		case "belongsTo":
+			lookupLet = wst.M{
+				*relation.ForeignKey: fmt.Sprintf("$%v", *relation.ForeignKey),
+			}
+			matching = wst.M{
+				"$eq": []string{fmt.Sprintf("$%v", *relation.PrimaryKey), fmt.Sprintf("$$%v", *relation.ForeignKey)},
+			}
+			break
+		case "hasOne", "hasMany":
+			lookupLet = wst.M{
+				*relation.ForeignKey: fmt.Sprintf("$%v", *relation.PrimaryKey),
+			}
+			matching = wst.M{
+				"$eq": []string{fmt.Sprintf("$%v", *relation.ForeignKey), fmt.Sprintf("$$%v", *relation.ForeignKey)},
+			}
+			break
+		}
+		pipeline := []interface{}{
+			wst.M{
+				"$match": wst.M{
+					"$expr": wst.M{
+						"$and": wst.A{
+							matching,
 						},
+					},
+				},
+			},
+		}
+		if relatedLoadedModel.Config.SoftDelete {
+			pipeline = append(pipeline, wst.M{
+				"$match": wst.M{softDeleteField: nil},
+			})
+		}
+		project := wst.M{}
+		for _, propertyName := range relatedLoadedModel.Config.Hidden {
+			project[propertyName] = false
+		}
+		if len(project) > 0 {
+			pipeline = append(pipeline, wst.M{
+				"$project": project,
+			})
+		}
+		if targetScope != nil {
+			nestedLoopkups := relatedLoadedModel.ExtractLookupsFromFilter(targetScope, disableTypeConversions)
+			if nestedLoopkups != nil {
+				for _, v := range *nestedLoopkups {
+					pipeline = append(pipeline, v)
+				}
+			}
+		}
+
+		stages = append(stages, wst.M{
+			"$lookup": wst.M{
+				"from":     relatedLoadedModel.CollectionName,
+				"let":      lookupLet,
+				"pipeline": pipeline,
+				"as":       relationName,
+			},
+		})
+		break
+	}
+	switch relation.Type {
+	case "hasOne", "belongsTo":
+		stages = append(stages, wst.M{
+			"$unwind": wst.M{
+				"path":                       fmt.Sprintf("$%v", relationName),
+				"preserveNullAndEmptyArrays": true,
+			},
+		})
+		break
+	}
+	return stages
+}
+
+// Field added by $graphLookup to every document found by a recursive include
+const recursiveDepthField = "_depth"
+
+// recursiveLookupStage returns a $graphLookup stage that loads every descendant (hasMany, hasOne) or ancestor
+// (belongsTo) of a self-referencing relation in a flat list. mergeRelated nests them afterwards.
+func (loadedModel *Model) recursiveLookupStage(relationName string, relation *Relation, includeItem wst.IncludeItem, disableTypeConversions bool) wst.M {
+	var startWith, connectFromField, connectToField string
+	switch relation.Type {
+	case "belongsTo":
+		startWith = *relation.ForeignKey
+		connectFromField = *relation.ForeignKey
+		connectToField = *relation.PrimaryKey
+		break
+	default:
+		startWith = *relation.PrimaryKey
+		connectFromField = *relation.PrimaryKey
+		connectToField = *relation.ForeignKey
+		break
+	}
+	graphLookup := wst.M{
+		"from":             loadedModel.CollectionName,
+		"startWith":        fmt.Sprintf("$%v", startWith),
+		"connectFromField": connectFromField,
+		"connectToField":   connectToField,
+		"as":               relationName,
+		"depthField":       recursiveDepthField,
+	}
+	if includeItem.MaxDepth > 0 {
+		// maxDepth counts the levels returned, while $graphLookup starts counting at 0
+		graphLookup["maxDepth"] = includeItem.MaxDepth - 1
+	}
+	restrictSearchWithMatch := wst.Where{}
+	if includeItem.Scope != nil && includeItem.Scope.Where != nil {
+		for key, value := range *includeItem.Scope.Where {
+			restrictSearchWithMatch[key] = value
+		}
+		if !disableTypeConversions {
+			datasource.ReplaceObjectIds(restrictSearchWithMatch)
+		}
+	}
+	if loadedModel.Config.SoftDelete {
+		restrictSearchWithMatch[softDeleteField] = nil
+	}
+	if len(restrictSearchWithMatch) > 0 {
+		graphLookup["restrictSearchWithMatch"] = restrictSearchWithMatch
+	}
+	return wst.M{"$graphLookup": graphLookup}
+}
+
+// validateRecursiveIncludes rejects the scopes of recursive includes that $graphLookup cannot apply. Only where is
+// supported, and it filters every level
+func validateRecursiveIncludes(filterMap *wst.Filter) error {
+	if filterMap == nil || filterMap.Include == nil {
+		return nil
+	}
+	for _, includeItem := range *filterMap.Include {
+		scope := includeItem.Scope
+		if !includeItem.Recursive || scope == nil {
+			continue
+		}
+		if (scope.Order != nil && len(*scope.Order) > 0) || scope.Skip > 0 || scope.Limit > 0 || scope.Include != nil || scope.Search != "" {
+			return wst.CreateError(fiber.ErrBadRequest, "INVALID_INCLUDE", fiber.Map{"message": fmt.Sprintf("The scope of the recursive include %v only supports where", includeItem.Relation)}, "ValidationError")
+		}
+	}
+	return nil
+}
+
+// mergeRecursiveRelated turns the flat list returned by recursiveLookupStage into nested documents, and checks the
+// __get__<relation> permission again on every level
+func (loadedModel *Model) mergeRecursiveRelated(relationDeepLevel byte, documents *wst.A, includeItem wst.IncludeItem, baseContext *EventContext) error {
+	relationName := includeItem.Relation
+	relation := (*loadedModel.Config.Relations)[relationName]
+
+	for _, document := range *documents {
+		found := whereItems(document[relationName])
+		delete(document, relationName)
+
+		byKey := map[string][]wst.M{}
+		for _, relatedDocument := range found {
+			for _, propertyName := range loadedModel.Config.Hidden {
+				delete(relatedDocument, propertyName)
+			}
+			var key interface{}
+			if relation.Type == "belongsTo" {
+				key = relatedDocument[*relation.PrimaryKey]
+			} else {
+				key = relatedDocument[*relation.ForeignKey]
+			}
+			if key != nil {
+				keySt := GetIDAsString(key)
+				byKey[keySt] = append(byKey[keySt], relatedDocument)
+			}
+		}
+
+		visited := map[string]bool{}
+		var nest func(parent wst.M)
+		nest = func(parent wst.M) {
+			var parentKey interface{}
+			if relation.Type == "belongsTo" {
+				parentKey = parent[*relation.ForeignKey]
+			} else {
+				parentKey = parent[*relation.PrimaryKey]
+			}
+			depth := parent[recursiveDepthField]
+			delete(parent, recursiveDepthField)
+			if parentKey == nil {
+				return
+			}
+			parentKeySt := GetIDAsString(parentKey)
+			if visited[parentKeySt] {
+				// Cycles in the tree are cut here
+				return
+			}
+			visited[parentKeySt] = true
+			if includeItem.MaxDepth > 0 && depth != nil && fmt.Sprintf("%v", depth) == fmt.Sprintf("%v", includeItem.MaxDepth-1) {
+				// Deepest level loaded, its own relation is unknown
+				return
+			}
+			children := byKey[parentKeySt]
+			switch {
+			case isSingleRelation(relation.Type):
+				if len(children) > 0 {
+					nest(children[0])
+					parent[relationName] = children[0]
+				}
+				break
+			case isManyRelation(relation.Type):
+				nested := make(primitive.A, 0, len(children))
+				for _, child := range children {
+					nest(child)
+					nested = append(nested, child)
+				}
+				parent[relationName] = nested
+				break
+			}
+		}
+		nest(document)
+	}
+
+	levelDocuments := *documents
+	for level := relationDeepLevel + 1; len(levelDocuments) > 0; level++ {
+		nextLevel := wst.A{}
+		for _, document := range levelDocuments {
+			nextLevel = append(nextLevel, whereItems(document[relationName])...)
+			if nested, ok := document[relationName].(wst.M); ok {
+				nextLevel = append(nextLevel, nested)
+			}
+		}
+		if len(nextLevel) == 0 {
+			break
+		}
+		if loadedModel.App.Debug {
+			log.Printf("DEBUG: Check recursive relation %v.%v at level %v (n=%v)\n", loadedModel.Name, relationName, level, len(nextLevel))
+		}
+		allowed, err := loadedModel.authorizeRelation(&nextLevel, relationName, relation, baseContext)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			break
+		}
+		levelDocuments = nextLevel
+	}
+
+	return nil
+}
+
+// relationFromField returns the name of the relation referenced by a dotted field like "user.email", or an empty
+// string if the field belongs to the model itself
+func (loadedModel *Model) relationFromField(field string) string {
+	idx := strings.Index(field, ".")
+	if idx <= 0 {
+		return ""
+	}
+	relationName := field[:idx]
+	if relation := (*loadedModel.Config.Relations)[relationName]; relation != nil && relation.Type != "hasAndBelongsToMany" {
+		return relationName
+	}
+	return ""
+}
+
+// isHiddenProperty reports whether field, or the property that contains it, is hidden
+func (loadedModel *Model) isHiddenProperty(field string) bool {
+	root := strings.Split(field, ".")[0]
+	for _, hidden := range loadedModel.Config.Hidden {
+		if hidden == root {
+			return true
+		}
+	}
+	return false
+}
+
+// relationsInFilter returns the sorted names of the relations referenced by the where and order clauses of filterMap
+func (loadedModel *Model) relationsInFilter(filterMap *wst.Filter) []string {
+	found := map[string]bool{}
+	if filterMap != nil && filterMap.Where != nil {
+		loadedModel.collectWhereRelations(wst.M(*filterMap.Where), found)
+	}
+	if filterMap != nil && filterMap.Order != nil {
+		for _, orderPair := range *filterMap.Order {
+			if relationName := loadedModel.relationFromField(strings.Split(orderPair, " ")[0]); relationName != "" {
+				found[relationName] = true
+			}
+		}
+	}
+	result := make([]string, 0, len(found))
+	for relationName := range found {
+		result = append(result, relationName)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (loadedModel *Model) collectWhereRelations(where wst.M, found map[string]bool) {
+	for key, value := range where {
+		if isLogicalOperator(key) {
+			for _, item := range whereItems(value) {
+				loadedModel.collectWhereRelations(item, found)
+			}
+			continue
+		}
+		if relationName := loadedModel.relationFromField(key); relationName != "" {
+			found[relationName] = true
+		}
+	}
+}
+
+// hiddenRelatedField returns the first field of the where and order clauses of filterMap that references a hidden
+// property of a relation, or an empty string if there is none
+func (loadedModel *Model) hiddenRelatedField(filterMap *wst.Filter) string {
+	var fields []string
+	if filterMap.Where != nil {
+		fields = whereFields(wst.M(*filterMap.Where), fields)
+	}
+	if filterMap.Order != nil {
+		for _, orderPair := range *filterMap.Order {
+			fields = append(fields, strings.Split(orderPair, " ")[0])
+		}
+	}
+	for _, field := range fields {
+		relationName := loadedModel.relationFromField(field)
+		if relationName == "" {
+			continue
+		}
+		relatedLoadedModel := (*loadedModel.modelRegistry)[(*loadedModel.Config.Relations)[relationName].Model]
+		if relatedLoadedModel != nil && relatedLoadedModel.isHiddenProperty(field[len(relationName)+1:]) {
+			return field
+		}
+	}
+	return ""
+}
+
+// whereFields appends to fields the keys of where that are not logical operators, including the nested ones
+func whereFields(where wst.M, fields []string) []string {
+	keys := make([]string, 0, len(where))
+	for key := range where {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if isLogicalOperator(key) {
+			for _, item := range whereItems(where[key]) {
+				fields = whereFields(item, fields)
+			}
+			continue
+		}
+		fields = append(fields, key)
+	}
+	return fields
+}
+
+// splitRelatedWhere separates the conditions that only reference fields of the model, which can be matched before
+// joining any relation, from the ones that need the related documents
+func (loadedModel *Model) splitRelatedWhere(where wst.Where) (rootWhere wst.Where, relatedWhere wst.Where) {
+	rootWhere = wst.Where{}
+	relatedWhere = wst.Where{}
+	for key, value := range where {
+		found := map[string]bool{}
+		loadedModel.collectWhereRelations(wst.M{key: value}, found)
+		if len(found) > 0 {
+			relatedWhere[key] = value
+		} else {
+			rootWhere[key] = value
+		}
+	}
+	return rootWhere, relatedWhere
+}
+
+// resolveRelatedFilter checks the permissions to filter or sort by the fields of the relations referenced in
+// filterMap. Conditions on relations stored in other datasources are resolved here with a pre-query, and replaced by
+// an $in condition over the matching keys.
+func (loadedModel *Model) resolveRelatedFilter(filterMap *wst.Filter, baseContext *EventContext) (*wst.Filter, error) {
+	relationNames := loadedModel.relationsInFilter(filterMap)
+	if len(relationNames) == 0 {
+		return filterMap, nil
+	}
+
+	needsPreQuery := false
+	for _, relationName := range relationNames {
+		relation := (*loadedModel.Config.Relations)[relationName]
+		relatedLoadedModel := (*loadedModel.modelRegistry)[relation.Model]
+		if relatedLoadedModel == nil {
+			return nil, errors.New("related model not found")
+		}
+
+		if !relation.Options.SkipAuth {
+			action := fmt.Sprintf("__get__%v", relationName)
+			err, allowed := loadedModel.EnforceEx(baseContext.Bearer, "*", action, baseContext)
+			if err != nil && err != fiber.ErrUnauthorized {
+				return nil, err
+			}
+			if !allowed {
+				return nil, wst.CreateError(fiber.ErrUnauthorized, "UNAUTHORIZED", fiber.Map{"message": fmt.Sprintf("Not allowed to filter by relation %v", relationName)}, "Error")
+			}
+		}
+
+		if relatedLoadedModel.Datasource.Name != loadedModel.Datasource.Name {
+			if filterMap.Order != nil {
+				for _, orderPair := range *filterMap.Order {
+					if loadedModel.relationFromField(strings.Split(orderPair, " ")[0]) == relationName {
+						return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_ORDER", fiber.Map{"message": fmt.Sprintf("Cannot sort by fields of %v, it belongs to another datasource", relationName)}, "ValidationError")
 					}
-					project := wst.M{}
-					for _, propertyName := range relatedLoadedModel.Config.Hidden {
-						project[propertyName] = false
-					}
-					if len(project) > 0 {
-						pipeline = append(pipeline, wst.M{
-							"$project": project,
-						})
-					}
-					if targetScope != nil {
-						nestedLoopkups := relatedLoadedModel.ExtractLookupsFromFilter(targetScope, disableTypeConversions)
-						if nestedLoopkups != nil {
-							for _, v := range *nestedLoopkups {
-								pipeline = append(pipeline, v)
-							}
-						}
-					}
+				}
+			}
+			needsPreQuery = true
+		}
+	}
 
-					*lookups = append(*lookups, wst.M{
-						"$lookup": wst.M{
-							"from":     relatedLoadedModel.CollectionName,
-							"let":      lookupLet,
-							"pipeline": pipeline,
-							"as":       relationName,
-						},
-					})
-					break
+	// Hidden properties cannot be matched or sorted, otherwise the results would reveal their values
+	if field := loadedModel.hiddenRelatedField(filterMap); field != "" {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "INVALID_WHERE", fiber.Map{"message": fmt.Sprintf("Cannot filter or sort by hidden property %v", field)}, "ValidationError")
+	}
+
+	if !needsPreQuery || filterMap.Where == nil {
+		return filterMap, nil
+	}
+
+	resolvedWhere, err := loadedModel.resolveCrossDatasourceWhere(wst.M(*filterMap.Where), baseContext)
+	if err != nil {
+		return nil, err
+	}
+	filterCopy := *filterMap
+	asWhere := wst.Where(resolvedWhere)
+	filterCopy.Where = &asWhere
+	return &filterCopy, nil
+}
+
+func (loadedModel *Model) resolveCrossDatasourceWhere(where wst.M, baseContext *EventContext) (wst.M, error) {
+	result := wst.M{}
+	relatedWheres := map[string]wst.Where{}
+	for key, value := range where {
+		if isLogicalOperator(key) {
+			items := whereItems(value)
+			resolvedItems := make([]wst.M, len(items))
+			for idx, item := range items {
+				resolvedItem, err := loadedModel.resolveCrossDatasourceWhere(item, baseContext)
+				if err != nil {
+					return nil, err
 				}
-				switch relation.Type {
-				case "hasOne", "belongsTo":
-					*lookups = append(*lookups, wst.M{
-						"$unwind": wst.M{
-							"path":                       fmt.Sprintf("$%v", relationName),
-							"preserveNullAndEmptyArrays": true,
-						},
-					})
-					break
+				resolvedItems[idx] = resolvedItem
+			}
+			result[key] = resolvedItems
+			continue
+		}
+		relationName := loadedModel.relationFromField(key)
+		if relationName != "" {
+			relation := (*loadedModel.Config.Relations)[relationName]
+			relatedLoadedModel := (*loadedModel.modelRegistry)[relation.Model]
+			if relatedLoadedModel.Datasource.Name != loadedModel.Datasource.Name {
+				relatedField := key[len(relationName)+1:]
+				if relatedWheres[relationName] == nil {
+					relatedWheres[relationName] = wst.Where{}
 				}
+				relatedWheres[relationName][relatedField] = value
+				continue
+			}
+		}
+		result[key] = value
+	}
 
+	var conditions []wst.M
+	for relationName, relatedWhere := range relatedWheres {
+		relation := (*loadedModel.Config.Relations)[relationName]
+		relatedLoadedModel := (*loadedModel.modelRegistry)[relation.Model]
+
+		keyFrom := ""
+		keyTo := ""
+		switch relation.Type {
+		case "belongsTo":
+			keyFrom = *relation.PrimaryKey
+			keyTo = *relation.ForeignKey
+			break
+		case "hasOne", "hasMany":
+			keyFrom = *relation.ForeignKey
+			keyTo = *relation.PrimaryKey
+			break
+		}
+
+		relatedWhereValue := relatedWhere
+		relatedInstances, err := relatedLoadedModel.FindMany(&wst.Filter{Where: &relatedWhereValue}, baseContext)
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]interface{}, 0, len(relatedInstances))
+		for _, relatedInstance := range relatedInstances {
+			if keyFrom == "_id" {
+				keys = append(keys, relatedInstance.Id)
+			} else if relatedInstance.data[keyFrom] != nil {
+				keys = append(keys, relatedInstance.data[keyFrom])
 			}
 		}
+		conditions = append(conditions, wst.M{keyTo: wst.M{"$in": keys}})
+	}
+	if len(conditions) > 0 {
+		if existing, ok := result["$and"].([]wst.M); ok {
+			result["$and"] = append(existing, conditions...)
+		} else {
+			result["$and"] = conditions
+		}
+	}
+	return result, nil
+}
 
-	} else {
+func isLogicalOperator(key string) bool {
+	return key == "$and" || key == "$or" || key == "$nor"
+}
 
+// whereItems converts the value of a logical operator ($and, $or, $nor) into a list of conditions
+func whereItems(value interface{}) []wst.M {
+	var result []wst.M
+	appendItem := func(item interface{}) {
+		switch item.(type) {
+		case wst.M:
+			result = append(result, item.(wst.M))
+		case wst.Where:
+			result = append(result, wst.M(item.(wst.Where)))
+		case map[string]interface{}:
+			result = append(result, item.(map[string]interface{}))
+		case primitive.M:
+			result = append(result, wst.M(item.(primitive.M)))
+		}
 	}
-	return lookups
+	switch value.(type) {
+	case []interface{}:
+		for _, item := range value.([]interface{}) {
+			appendItem(item)
+		}
+	case primitive.A:
+		for _, item := range value.(primitive.A) {
+			appendItem(item)
+		}
+	case []wst.M:
+		result = append(result, value.([]wst.M)...)
+	case wst.A:
+		result = append(result, value.(wst.A)...)
+	}
+	return result
 }
 
 /*
@@ -225,31 +800,13 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 		return nil
 	}
 
-	//if relation.Options.SkipAuth && relationDeepLevel > 1 {
-	// Only skip auth checking for relations above the level 1
-	if relation.Options.SkipAuth {
-		if loadedModel.App.Debug {
-			log.Printf("DEBUG: SkipAuth %v.%v\n", loadedModel.Name, relationName)
-		}
-	} else {
-		objId := "*"
-		if len(*documents) == 1 {
-			objId = (*documents)[0]["_id"].(primitive.ObjectID).Hex()
-		}
+	if includeItem.Recursive && (relatedLoadedModel != loadedModel || relation.Type == "hasAndBelongsToMany") {
+		return wst.CreateError(fiber.ErrBadRequest, "INVALID_INCLUDE", fiber.Map{"message": fmt.Sprintf("Relation %v.%v cannot be included recursively, it does not reference the same model", loadedModel.Name, relationName)}, "ValidationError")
+	}
 
-		action := fmt.Sprintf("__get__%v", relationName)
-		if loadedModel.App.Debug {
-			log.Printf("DEBUG: Check %v.%v\n", loadedModel.Name, action)
-		}
-		err, allowed := loadedModel.EnforceEx(baseContext.Bearer, objId, action, baseContext)
-		if err != nil && err != fiber.ErrUnauthorized {
-			return err
-		}
-		if !allowed {
-			for _, doc := range *documents {
-				delete(doc, relationName)
-			}
-		}
+	_, err := loadedModel.authorizeRelation(documents, relationName, relation, baseContext)
+	if err != nil {
+		return err
 	}
 
 	if relatedLoadedModel.Datasource.Name != loadedModel.Datasource.Name {
@@ -284,6 +841,8 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 
 			cachedRelatedDocs := make([]InstanceA, len(*documents))
 			localCache := map[string]InstanceA{}
+			pendingKeys := make([]interface{}, 0)
+			pendingKeysSet := map[string]bool{}
 
 			for documentIdx, document := range *documents {
 
@@ -328,19 +887,68 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 
 				}
 
-				relatedInstances := cachedRelatedDocs[documentIdx]
-				if relatedInstances == nil {
+				if cachedRelatedDocs[documentIdx] == nil && document[keyTo] != nil {
+					pendingKey := GetIDAsString(document[keyTo])
+					if !pendingKeysSet[pendingKey] {
+						pendingKeysSet[pendingKey] = true
+						pendingKeys = append(pendingKeys, document[keyTo])
+					}
+				}
+
+			}
 
-					(*targetScope.Where)[keyFrom] = document[keyTo]
-					if isSingleRelation(relation.Type) {
-						targetScope.Limit = 1
+			// Load the related documents of every parent with a single query instead of one query per parent
+			relatedByKey := map[string]InstanceA{}
+			if len(pendingKeys) > 0 {
+				batchWhere := wst.Where{}
+				for k, v := range *targetScope.Where {
+					batchWhere[k] = v
+				}
+				batchWhere[keyFrom] = wst.M{"$in": pendingKeys}
+				batchScope := *targetScope
+				batchScope.Where = &batchWhere
+				// skip and limit apply to every parent, not to the whole batch
+				batchScope.Skip = 0
+				batchScope.Limit = 0
+				var perParentStages wst.A
+				if targetScope.Limit > 0 {
+					// Keep at most skip + limit documents per parent in the pipeline. The exact skip and limit are applied
+					// below, because the same key may be stored as ObjectID and as string
+					perParentStages = wst.A{
+						{"$group": wst.M{"_id": "$" + keyFrom, "documents": wst.M{"$push": "$$ROOT"}}},
+						{"$project": wst.M{"documents": wst.M{"$slice": []interface{}{"$documents", targetScope.Skip + targetScope.Limit}}}},
+						{"$unwind": "$documents"},
+						{"$replaceRoot": wst.M{"newRoot": "$documents"}},
 					}
+				}
 
-					var err error
-					relatedInstances, err = relatedLoadedModel.FindMany(targetScope, baseContext)
-					if err != nil {
-						return err
+				relatedInstances, err := relatedLoadedModel.findMany(&batchScope, baseContext, perParentStages)
+				if err != nil {
+					return err
+				}
+				for _, relatedInstance := range relatedInstances {
+					var relatedKey interface{}
+					if keyFrom == "_id" {
+						relatedKey = relatedInstance.Id
+					} else {
+						relatedKey = relatedInstance.data[keyFrom]
+					}
+					if relatedKey == nil {
+						continue
+					}
+					relatedKeySt := GetIDAsString(relatedKey)
+					relatedByKey[relatedKeySt] = append(relatedByKey[relatedKeySt], relatedInstance)
+				}
+			}
+
+			for documentIdx, document := range *documents {
+
+				relatedInstances := cachedRelatedDocs[documentIdx]
+				if relatedInstances == nil {
+					if document[keyTo] != nil {
+						relatedInstances = relatedByKey[GetIDAsString(document[keyTo])]
 					}
+					relatedInstances = limitRelatedInstances(relatedInstances, targetScope.Skip, targetScope.Limit)
 				} else {
 					if loadedModel.App.Debug {
 						log.Printf("Found cache for %v.%v[%v]\n", loadedModel.Name, relationName, documentIdx)
@@ -362,7 +970,11 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 					}
 					break
 				case isManyRelation(relation.Type):
-					document[relationName] = relatedInstances
+					if relatedInstances == nil {
+						relatedInstances = InstanceA{}
+					}
+					// Build() expects a plain []Instance
+					document[relationName] = []Instance(relatedInstances)
 					break
 				}
 
@@ -371,6 +983,10 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 			break
 		}
 
+	} else if includeItem.Recursive {
+
+		return loadedModel.mergeRecursiveRelated(relationDeepLevel, documents, includeItem, baseContext)
+
 	} else {
 
 		if includeItem.Scope != nil && documents != nil && len(*documents) > 0 {
@@ -445,3 +1061,49 @@ func (loadedModel *Model) mergeRelated(relationDeepLevel byte, documents *wst.A,
 
 	return nil
 }
+
+// limitRelatedInstances applies the skip and limit of an include scope to the related instances of a single parent
+func limitRelatedInstances(relatedInstances InstanceA, skip int64, limit int64) InstanceA {
+	if skip > 0 {
+		if skip >= int64(len(relatedInstances)) {
+			return InstanceA{}
+		}
+		relatedInstances = relatedInstances[skip:]
+	}
+	if limit > 0 && limit < int64(len(relatedInstances)) {
+		relatedInstances = relatedInstances[:limit]
+	}
+	return relatedInstances
+}
+
+// authorizeRelation checks the __get__<relation> permission of the bearer over documents. When it is not granted the
+// relation is removed from every document and false is returned.
+func (loadedModel *Model) authorizeRelation(documents *wst.A, relationName string, relation *Relation, baseContext *EventContext) (bool, error) {
+	if relation.Options.SkipAuth {
+		if loadedModel.App.Debug {
+			log.Printf("DEBUG: SkipAuth %v.%v\n", loadedModel.Name, relationName)
+		}
+	} else {
+		objId := "*"
+		if len(*documents) == 1 && (*documents)[0]["_id"] != nil {
+			objId = GetIDAsString((*documents)[0]["_id"])
+		}
+
+		action := fmt.Sprintf("__get__%v", relationName)
+		if loadedModel.App.Debug {
+			log.Printf("DEBUG: Check %v.%v\n", loadedModel.Name, action)
+		}
+		err, allowed := loadedModel.EnforceEx(baseContext.Bearer, objId, action, baseContext)
+		if err != nil && err != fiber.ErrUnauthorized {
+			return false, err
+		}
+		if !allowed {
+			for _, doc := range *documents {
+				delete(doc, relationName)
+			}
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -351,6 +351,9 @@ func (loadedModel *Model) HandleRemoteMethod(name string, eventContext *EventCon
 	if err != nil {
 		return err
 	}
+	if eventContext.Ctx.Response().IsBodyStream() {
+		return nil
+	}
 	if eventContext.Result != nil || eventContext.StatusCode != 0 {
 		if eventContext.StatusCode == 0 {
 			eventContext.StatusCode = fiber.StatusOK
@@ -0,0 +1,98 @@
+package model
+
+import (
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+/*
+MergeFilters returns a new filter combining base and override:
+  - where clauses are joined with $and, or merged into the same map if they do not share any key, so conditions like
+    "near" stay at the root
+  - order, skip, limit and search from override replace the ones in base
+  - include items are concatenated
+*/
+func MergeFilters(base *wst.Filter, override *wst.Filter) *wst.Filter {
+	if base == nil {
+		return override
+	}
+	if override == nil {
+		baseCopy := *base
+		return &baseCopy
+	}
+	merged := *base
+
+	if override.Where != nil && len(*override.Where) > 0 {
+		if base.Where != nil && len(*base.Where) > 0 {
+			merged.Where = mergeWheres(*base.Where, *override.Where)
+		} else {
+			merged.Where = override.Where
+		}
+	}
+	if override.Order != nil && len(*override.Order) > 0 {
+		merged.Order = override.Order
+	}
+	if override.Skip > 0 {
+		merged.Skip = override.Skip
+	}
+	if override.Limit > 0 {
+		merged.Limit = override.Limit
+	}
+	if override.Search != "" {
+		merged.Search = override.Search
+	}
+	if override.Include != nil {
+		include := wst.Include{}
+		if base.Include != nil {
+			include = append(include, *base.Include...)
+		}
+		include = append(include, *override.Include...)
+		merged.Include = &include
+	}
+	return &merged
+}
+
+func mergeWheres(base wst.Where, override wst.Where) *wst.Where {
+	for key := range override {
+		if _, exists := base[key]; exists {
+			return &wst.Where{"$and": []wst.M{wst.M(base), wst.M(override)}}
+		}
+	}
+	merged := wst.Where{}
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		merged[key] = value
+	}
+	return &merged
+}
+
+// Scope finds the instances matching the named scope declared in the model config, merged with filterMap
+func (loadedModel *Model) Scope(name string, filterMap *wst.Filter, baseContext *EventContext) (InstanceA, error) {
+	scope, ok := loadedModel.Config.Scopes[name]
+	if !ok {
+		return nil, wst.CreateError(fiber.ErrNotFound, "SCOPE_NOT_FOUND", fiber.Map{"message": fmt.Sprintf("Scope %v not found in %v", name, loadedModel.Name)}, "Error")
+	}
+	return loadedModel.FindMany(MergeFilters(&scope, filterMap), baseContext)
+}
+
+// isSystemContext reports whether the root of baseContext belongs to a system bearer, which bypasses the default scope
+func isSystemContext(baseContext *EventContext) bool {
+	if baseContext == nil {
+		return false
+	}
+	var targetBaseContext = baseContext
+	for {
+		if targetBaseContext.BaseContext != nil {
+			targetBaseContext = targetBaseContext.BaseContext
+		} else {
+			break
+		}
+	}
+	bearer := targetBaseContext.Bearer
+	return bearer != nil && bearer.User != nil && bearer.User.System
+}
@@ -0,0 +1,121 @@
+package model
+
+import (
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+)
+
+// Field set by DeleteById on models with "softDelete": true. Documents with this field are excluded from every query
+const softDeleteField = "deletedAt"
+
+// Restore undoes the soft delete of the document, and returns the restored instance. It runs the "before restore" and
+// "after restore" hooks instead of the delete ones
+func (loadedModel *Model) Restore(id interface{}, baseContext *EventContext) (*Instance, error) {
+	if !loadedModel.Config.SoftDelete {
+		return nil, wst.CreateError(fiber.ErrBadRequest, "SOFT_DELETE_DISABLED", fiber.Map{"message": "Soft delete is not enabled for " + loadedModel.Name}, "Error")
+	}
+	finalId := loadedModel.documentId(id, "Restore")
+	eventContext := loadedModel.deleteEventContext(finalId, baseContext)
+	err := loadedModel.runDeleteHook("__operation__before_restore", eventContext)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := loadedModel.datasourceFor(eventContext)
+	if err != nil {
+		return nil, err
+	}
+	matchedCount, err := ds.UpdateOne(loadedModel.CollectionName, wst.M{"_id": finalId, softDeleteField: wst.M{"$ne": nil}}, wst.M{"$unset": wst.M{softDeleteField: ""}})
+	if err != nil {
+		return nil, err
+	}
+	if matchedCount == 0 {
+		return nil, datasource.NewError(fiber.StatusNotFound, "Document not found")
+	}
+	restored, err := loadedModel.FindById(finalId, nil, eventContext)
+	if err != nil {
+		return nil, err
+	}
+	err = loadedModel.recordAudit("restore", finalId, nil, restored.ToJSON(), eventContext)
+	if err != nil {
+		return nil, err
+	}
+	err = loadedModel.runDeleteHook("__operation__after_restore", eventContext)
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+// Purge removes the document permanently, whether it was soft deleted or not, and applies the "onDelete" option of
+// its relations like DeleteById
+func (loadedModel *Model) Purge(id interface{}, baseContext *EventContext) (int64, error) {
+	finalId := loadedModel.documentId(id, "Purge")
+	eventContext := loadedModel.deleteEventContext(finalId, baseContext)
+	return loadedModel.inCascadeTransaction(eventContext, func() (int64, error) {
+		return loadedModel.purge(finalId, eventContext)
+	})
+}
+
+func (loadedModel *Model) purge(finalId interface{}, eventContext *EventContext) (int64, error) {
+	err := loadedModel.runDeleteHook("__operation__before_delete", eventContext)
+	if err != nil {
+		return 0, err
+	}
+	ds, err := loadedModel.datasourceFor(eventContext)
+	if err != nil {
+		return 0, err
+	}
+	deletedCount := ds.DeleteById(loadedModel.CollectionName, finalId)
+	if deletedCount == 0 {
+		return 0, datasource.NewError(fiber.StatusNotFound, "Document not found")
+	}
+	err = loadedModel.recordAudit("purge", finalId, nil, nil, eventContext)
+	if err != nil {
+		return 0, err
+	}
+	err = loadedModel.deleteRelated(finalId, eventContext)
+	if err != nil {
+		return 0, err
+	}
+	err = loadedModel.runDeleteHook("__operation__after_delete", eventContext)
+	if err != nil {
+		return 0, err
+	}
+	return deletedCount, nil
+}
+
+// deleteEventContext builds the context passed to the delete hooks, derived from the root of baseContext. It keeps the
+// transaction of baseContext, and the instances deleted so far when baseContext comes from a cascade
+func (loadedModel *Model) deleteEventContext(finalId interface{}, baseContext *EventContext) *EventContext {
+	if baseContext == nil {
+		baseContext = &EventContext{}
+	}
+	var targetBaseContext = baseContext
+	for {
+		if targetBaseContext.BaseContext != nil {
+			targetBaseContext = targetBaseContext.BaseContext
+		} else {
+			break
+		}
+	}
+	deletedInstances := baseContext.deletedInstances
+	if deletedInstances == nil {
+		deletedInstances = map[string]bool{}
+	}
+	deletedInstances[deletedInstanceKey(loadedModel, finalId)] = true
+	return &EventContext{
+		BaseContext:      targetBaseContext,
+		ModelID:          finalId,
+		Transaction:      transactionOf(baseContext),
+		deletedInstances: deletedInstances,
+	}
+}
+
+func (loadedModel *Model) runDeleteHook(operation string, eventContext *EventContext) error {
+	if loadedModel.DisabledHandlers[operation] == true {
+		return nil
+	}
+	return loadedModel.GetHandler(operation)(eventContext)
+}
@@ -0,0 +1,78 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+// Update operators allowed in updates, for the properties that declare them in "updateOperators"
+var SupportedUpdateOperators = map[string]bool{
+	"$inc":      true,
+	"$push":     true,
+	"$pull":     true,
+	"$addToSet": true,
+}
+
+// UpdateOperatorAction returns the casbin action that allows to apply operator to propertyName, like __inc__views
+func UpdateOperatorAction(operator string, propertyName string) string {
+	return fmt.Sprintf("__%v__%v", strings.TrimPrefix(operator, "$"), propertyName)
+}
+
+func isUpdateOperator(key string) bool {
+	return strings.HasPrefix(key, "$")
+}
+
+// checkUpdateOperators validates the update operators in data, like {"$inc": {"views": 1}}. Every property must declare
+// the operator in "updateOperators", and remote requests must be allowed by the __<operator>__<property> action
+func (modelInstance *Instance) checkUpdateOperators(data wst.M, baseContext *EventContext) error {
+	loadedModel := modelInstance.Model
+	for key, value := range data {
+		if !isUpdateOperator(key) {
+			continue
+		}
+		if !SupportedUpdateOperators[key] {
+			return wst.CreateError(fiber.ErrBadRequest, "INVALID_UPDATE_OPERATOR", fiber.Map{"message": fmt.Sprintf("Update operator %v is not supported", key)}, "ValidationError")
+		}
+		fields := toM(value)
+		if len(fields) == 0 {
+			return wst.CreateError(fiber.ErrBadRequest, "INVALID_UPDATE_OPERATOR", fiber.Map{"message": fmt.Sprintf("%v expects an object with the properties to update", key)}, "ValidationError")
+		}
+		for propertyName := range fields {
+			if !loadedModel.allowsUpdateOperator(key, propertyName) {
+				return wst.CreateError(fiber.ErrBadRequest, "INVALID_UPDATE_OPERATOR", fiber.Map{"message": fmt.Sprintf("%v is not allowed for %v", key, propertyName)}, "ValidationError")
+			}
+			if _, isSet := data[propertyName]; isSet {
+				return wst.CreateError(fiber.ErrBadRequest, "INVALID_UPDATE_OPERATOR", fiber.Map{"message": fmt.Sprintf("%v cannot be set and updated with %v at the same time", propertyName, key)}, "ValidationError")
+			}
+			// Go code calling UpdateAttributes without a request or bearer, or with a system bearer, is trusted
+			if baseContext.Ctx != nil || (baseContext.Bearer != nil && !isSystemContext(baseContext)) {
+				err, allowed := loadedModel.EnforceEx(baseContext.Bearer, GetIDAsString(modelInstance.Id), UpdateOperatorAction(key, propertyName), baseContext)
+				if err != nil && err != fiber.ErrUnauthorized {
+					return err
+				}
+				if !allowed {
+					return wst.CreateError(fiber.ErrUnauthorized, "UNAUTHORIZED", fiber.Map{"message": fmt.Sprintf("Not allowed to apply %v to %v", key, propertyName)}, "Error")
+				}
+			}
+		}
+		data[key] = fields
+	}
+	return nil
+}
+
+func (loadedModel *Model) allowsUpdateOperator(operator string, propertyName string) bool {
+	property, ok := loadedModel.Config.Properties[propertyName]
+	if !ok {
+		return false
+	}
+	for _, allowed := range property.UpdateOperators {
+		if allowed == operator {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+)
+
+// Field kept by models with "versioned": true. It starts at 1 and is incremented by every update
+const versionField = "_version"
+
+// GetVersion returns the version of the instance, or 0 if its model is not versioned
+func (modelInstance *Instance) GetVersion() int64 {
+	version, _ := toFloat64(modelInstance.data[versionField])
+	return int64(version)
+}
+
+/*
+expectedVersion returns the version the update is based on. It is taken, in this order, from:
+  - the "_version" field of the payload, which is removed from data
+  - the If-Match header of the request
+  - the version of the instance when it was loaded
+*/
+func (modelInstance *Instance) expectedVersion(data wst.M, baseContext *EventContext) (int64, error) {
+	if rawVersion, ok := data[versionField]; ok {
+		delete(data, versionField)
+		version, isNumber := toFloat64(rawVersion)
+		if !isNumber {
+			return 0, wst.CreateError(fiber.ErrBadRequest, "INVALID_VERSION", fiber.Map{"message": fmt.Sprintf("Invalid %v %v", versionField, rawVersion)}, "ValidationError")
+		}
+		return int64(version), nil
+	}
+	if baseContext != nil && baseContext.Ctx != nil {
+		ifMatch := strings.TrimSpace(baseContext.Ctx.Get(fiber.HeaderIfMatch))
+		ifMatch = strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`)
+		if ifMatch != "" && ifMatch != "*" {
+			version, err := strconv.ParseInt(ifMatch, 10, 64)
+			if err != nil {
+				return 0, wst.CreateError(fiber.ErrBadRequest, "INVALID_VERSION", fiber.Map{"message": fmt.Sprintf("Invalid If-Match header %v", ifMatch)}, "ValidationError")
+			}
+			return version, nil
+		}
+	}
+	return modelInstance.GetVersion(), nil
+}
+
+// updateVersioned applies data only if the stored document is still at expectedVersion, and increments its version
+func (modelInstance *Instance) updateVersioned(ds *datasource.Datasource, data wst.M, expectedVersion int64) (*wst.M, error) {
+	delete(data, "id")
+	delete(data, "_id")
+	delete(data, versionField)
+	update := datasource.BuildUpdate(data)
+	inc := wst.M{}
+	if existingInc := toM(update["$inc"]); existingInc != nil {
+		for key, value := range existingInc {
+			inc[key] = value
+		}
+	}
+	inc[versionField] = 1
+	update["$inc"] = inc
+	matchedCount, err := ds.UpdateOne(modelInstance.Model.CollectionName, wst.M{"_id": modelInstance.Id, versionField: expectedVersion}, update)
+	if err != nil {
+		return nil, err
+	}
+	if matchedCount == 0 {
+		return nil, wst.CreateError(fiber.ErrConflict, "VERSION_CONFLICT", fiber.Map{"message": fmt.Sprintf("%v %v was modified after version %v", modelInstance.Model.Name, modelInstance.Id, expectedVersion)}, "Error")
+	}
+	return &data, nil
+}
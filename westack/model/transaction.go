@@ -0,0 +1,107 @@
+package model
+
+import (
+	"log"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/fredyk/westack-go/westack/datasource"
+)
+
+// Transaction keeps one session per datasource touched by the operations run inside it. Sessions are started lazily,
+// and are not safe for concurrent use
+type Transaction struct {
+	sessions    map[string]mongo.Session
+	datasources map[string]*datasource.Datasource
+	mutex       sync.Mutex
+}
+
+func NewTransaction() *Transaction {
+	return &Transaction{
+		sessions:    map[string]mongo.Session{},
+		datasources: map[string]*datasource.Datasource{},
+	}
+}
+
+// datasource returns a copy of ds bound to the session of this transaction, starting it if needed
+func (transaction *Transaction) datasource(ds *datasource.Datasource) (*datasource.Datasource, error) {
+	transaction.mutex.Lock()
+	defer transaction.mutex.Unlock()
+
+	if txDatasource, ok := transaction.datasources[ds.Name]; ok {
+		return txDatasource, nil
+	}
+	session, err := ds.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	err = session.StartTransaction()
+	if err != nil {
+		session.EndSession(ds.Context)
+		return nil, err
+	}
+	txDatasource := ds.WithContext(mongo.NewSessionContext(ds.Context, session))
+	transaction.sessions[ds.Name] = session
+	transaction.datasources[ds.Name] = txDatasource
+	return txDatasource, nil
+}
+
+// Commit commits the transaction in every datasource. If one of them fails, the remaining ones are aborted
+func (transaction *Transaction) Commit() error {
+	transaction.mutex.Lock()
+	defer transaction.mutex.Unlock()
+
+	var commitErr error
+	for dsName, session := range transaction.sessions {
+		ctx := transaction.datasources[dsName].Context
+		if commitErr == nil {
+			commitErr = session.CommitTransaction(ctx)
+		} else if err := session.AbortTransaction(ctx); err != nil {
+			log.Printf("ERROR: Could not abort transaction in %v: %v\n", dsName, err)
+		}
+		session.EndSession(ctx)
+	}
+	transaction.reset()
+	return commitErr
+}
+
+// Abort discards the changes made in every datasource
+func (transaction *Transaction) Abort() error {
+	transaction.mutex.Lock()
+	defer transaction.mutex.Unlock()
+
+	var abortErr error
+	for dsName, session := range transaction.sessions {
+		ctx := transaction.datasources[dsName].Context
+		if err := session.AbortTransaction(ctx); err != nil && abortErr == nil {
+			abortErr = err
+		}
+		session.EndSession(ctx)
+	}
+	transaction.reset()
+	return abortErr
+}
+
+func (transaction *Transaction) reset() {
+	transaction.sessions = map[string]mongo.Session{}
+	transaction.datasources = map[string]*datasource.Datasource{}
+}
+
+// transactionOf returns the transaction of baseContext or of the contexts it derives from, nil if there is none
+func transactionOf(baseContext *EventContext) *Transaction {
+	for current := baseContext; current != nil; current = current.BaseContext {
+		if current.Transaction != nil {
+			return current.Transaction
+		}
+	}
+	return nil
+}
+
+// datasourceFor returns the datasource of the model, bound to the transaction of baseContext if there is one
+func (loadedModel *Model) datasourceFor(baseContext *EventContext) (*datasource.Datasource, error) {
+	if transaction := transactionOf(baseContext); transaction != nil {
+		return transaction.datasource(loadedModel.Datasource)
+	}
+	return loadedModel.Datasource, nil
+}
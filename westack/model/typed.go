@@ -0,0 +1,158 @@
+package model
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+)
+
+/*
+TypedModel binds a model to the Go struct T. Structs are converted with their bson tags, and the instance id is read
+from and written to the "id" key, as Instance.Transform() does:
+
+	type Note struct {
+		Id    primitive.ObjectID `bson:"id,omitempty"`
+		Title string             `bson:"title"`
+	}
+
+	notes := model.Typed[Note](noteModel)
+	note, err := notes.Create(Note{Title: "A note"}, nil)
+
+Every method calls the Model method with the same name, so hooks and permission checks behave in the same way.
+*/
+type TypedModel[T any] struct {
+	Model *Model
+}
+
+func Typed[T any](loadedModel *Model) *TypedModel[T] {
+	return &TypedModel[T]{Model: loadedModel}
+}
+
+func (typedModel *TypedModel[T]) Create(data T, baseContext *EventContext) (*T, error) {
+	asM, err := typedToM(data)
+	if err != nil {
+		return nil, err
+	}
+	created, err := typedModel.Model.Create(asM, baseContext)
+	if err != nil {
+		return nil, err
+	}
+	return instanceToTyped[T](created)
+}
+
+func (typedModel *TypedModel[T]) FindMany(filterMap *wst.Filter, baseContext *EventContext) ([]T, error) {
+	instances, err := typedModel.Model.FindMany(filterMap, baseContext)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]T, len(instances))
+	for idx := range instances {
+		err := instances[idx].Transform(&result[idx])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (typedModel *TypedModel[T]) FindOne(filterMap *wst.Filter, baseContext *EventContext) (*T, error) {
+	instance, err := typedModel.Model.FindOne(filterMap, baseContext)
+	if err != nil {
+		return nil, err
+	}
+	return instanceToTyped[T](instance)
+}
+
+// FindById returns nil without error if the instance does not exist
+func (typedModel *TypedModel[T]) FindById(id interface{}, filterMap *wst.Filter, baseContext *EventContext) (*T, error) {
+	instance, err := typedModel.Model.FindById(id, filterMap, baseContext)
+	if err != nil {
+		return nil, err
+	}
+	return instanceToTyped[T](instance)
+}
+
+/*
+Update applies partial to the instance and returns it updated. partial can be a wst.M or a struct. Every field of a
+struct is written, so use omitempty in the bson tags of the fields that should be left unchanged when empty.
+*/
+func (typedModel *TypedModel[T]) Update(id interface{}, partial interface{}, baseContext *EventContext) (*T, error) {
+	instance, err := typedModel.Model.FindById(id, nil, baseContext)
+	if err != nil {
+		return nil, err
+	}
+	if instance == nil {
+		return nil, nil
+	}
+	var data wst.M
+	switch partial.(type) {
+	case wst.M:
+		data = partial.(wst.M)
+		break
+	case map[string]interface{}:
+		data = partial.(map[string]interface{})
+		break
+	default:
+		data, err = typedToM(partial)
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	delete(data, "id")
+	delete(data, "_id")
+	updated, err := instance.UpdateAttributes(data, baseContext)
+	if err != nil {
+		return nil, err
+	}
+	return instanceToTyped[T](updated)
+}
+
+func (typedModel *TypedModel[T]) Delete(id interface{}, baseContext *EventContext) (int64, error) {
+	return typedModel.Model.DeleteById(id, baseContext)
+}
+
+// typedToM converts a struct to a wst.M ready to be saved. Empty ids are removed so the datasource assigns a new one
+func typedToM(data interface{}) (wst.M, error) {
+	var result wst.M
+	err := wst.Transform(data, &result)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"id", "_id"} {
+		if isEmptyId(result[key]) {
+			delete(result, key)
+		}
+	}
+	if result["id"] != nil {
+		if result["_id"] == nil {
+			result["_id"] = result["id"]
+		}
+		delete(result, "id")
+	}
+	return result, nil
+}
+
+func isEmptyId(id interface{}) bool {
+	switch id.(type) {
+	case nil:
+		return true
+	case primitive.ObjectID:
+		return id.(primitive.ObjectID).IsZero()
+	case string:
+		return id.(string) == ""
+	}
+	return false
+}
+
+func instanceToTyped[T any](instance *Instance) (*T, error) {
+	if instance == nil {
+		return nil, nil
+	}
+	var result T
+	err := instance.Transform(&result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,425 @@
+package westack
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+// Lifetime of the state parameter, the time the user has to log in at the provider
+const oauthStateTtl = 10 * time.Minute
+
+// Cookie that binds the state to the browser that started the login, so a callback url cannot be used in another one
+const oauthStateCookie = "westack_oauth_state"
+
+// Cookie with the PKCE code verifier. It never appears in an url, so an intercepted code cannot be exchanged
+const oauthVerifierCookie = "westack_oauth_verifier"
+
+/*
+OAuthProvider is an OAuth2 or OpenID Connect provider, configured in oauth.providers in config.json or added with
+WeStack.AddOAuthProvider(). With Issuer, the urls that are not set are read from its
+/.well-known/openid-configuration document
+*/
+type OAuthProvider struct {
+	ClientId         string   `mapstructure:"clientId"`
+	ClientSecret     string   `mapstructure:"clientSecret"`
+	Issuer           string   `mapstructure:"issuer"`
+	AuthorizationUrl string   `mapstructure:"authorizationUrl"`
+	TokenUrl         string   `mapstructure:"tokenUrl"`
+	UserInfoUrl      string   `mapstructure:"userInfoUrl"`
+	Scopes           []string `mapstructure:"scopes"`
+	// Callback url registered at the provider, <public url>/<users url>/auth/<provider>/callback. Required
+	RedirectUrl string `mapstructure:"redirectUrl"`
+	// If set, the callback redirects here with the tokens in the fragment instead of responding with JSON. It must be
+	// one of AllowedRedirects
+	SuccessRedirect string `mapstructure:"successRedirect"`
+	// Urls that the login can choose with ?redirect=<url>, instead of SuccessRedirect
+	AllowedRedirects []string `mapstructure:"allowedRedirects"`
+
+	discovered bool
+	mutex      sync.Mutex
+}
+
+// AddOAuthProvider registers a provider for GET /<users>/auth/<name>. It replaces the one with the same name in config.json
+func (app *WeStack) AddOAuthProvider(name string, provider *OAuthProvider) {
+	provider.validate(name)
+	app.oauthMutex.Lock()
+	defer app.oauthMutex.Unlock()
+	if app.oauthProviders == nil {
+		app.oauthProviders = map[string]*OAuthProvider{}
+	}
+	app.oauthProviders[name] = provider
+}
+
+func (app *WeStack) loadOAuthProviders() {
+	var providers map[string]*OAuthProvider
+	err := app.viper.UnmarshalKey("oauth.providers", &providers)
+	if err != nil {
+		panic(fmt.Errorf("invalid oauth.providers: %w", err))
+	}
+	for name, provider := range providers {
+		app.AddOAuthProvider(name, provider)
+	}
+}
+
+// validate panics if the provider cannot be used. The urls are not derived from the Host header, which the client controls
+func (provider *OAuthProvider) validate(name string) {
+	if provider.ClientId == "" {
+		panic(fmt.Sprintf("oauth provider %v needs a clientId", name))
+	}
+	if provider.Issuer == "" && (provider.AuthorizationUrl == "" || provider.TokenUrl == "" || provider.UserInfoUrl == "") {
+		panic(fmt.Sprintf("oauth provider %v needs an issuer, or authorizationUrl, tokenUrl and userInfoUrl", name))
+	}
+	if !isAbsoluteUrl(provider.RedirectUrl) {
+		panic(fmt.Sprintf("oauth provider %v needs an absolute redirectUrl", name))
+	}
+	for _, allowed := range provider.AllowedRedirects {
+		if !isAbsoluteUrl(allowed) {
+			panic(fmt.Sprintf("invalid url %v in allowedRedirects of oauth provider %v", allowed, name))
+		}
+	}
+	if provider.SuccessRedirect != "" && !provider.isAllowedRedirect(provider.SuccessRedirect) {
+		panic(fmt.Sprintf("the successRedirect of oauth provider %v must be one of its allowedRedirects", name))
+	}
+}
+
+func (provider *OAuthProvider) isAllowedRedirect(target string) bool {
+	for _, allowed := range provider.AllowedRedirects {
+		if target == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// isAbsoluteUrl reports whether rawUrl is an http or https url with a host and without fragment
+func isAbsoluteUrl(rawUrl string) bool {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+	return (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != "" && parsed.Fragment == ""
+}
+
+func (app *WeStack) findOAuthProvider(name string) (*OAuthProvider, error) {
+	app.oauthMutex.RLock()
+	provider := app.oauthProviders[name]
+	app.oauthMutex.RUnlock()
+	if provider == nil {
+		return nil, wst.CreateError(fiber.ErrNotFound, "UNKNOWN_PROVIDER", fiber.Map{"message": fmt.Sprintf("Unknown provider %v", name)}, "Error")
+	}
+	err := provider.discover()
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// discover fills the missing urls from the OpenID Connect discovery document of the issuer
+func (provider *OAuthProvider) discover() error {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.discovered || provider.Issuer == "" || (provider.AuthorizationUrl != "" && provider.TokenUrl != "" && provider.UserInfoUrl != "") {
+		return nil
+	}
+	var document struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	err := oauthRequest("GET", strings.TrimSuffix(provider.Issuer, "/")+"/.well-known/openid-configuration", nil, "", &document)
+	if err != nil {
+		return err
+	}
+	if provider.AuthorizationUrl == "" {
+		provider.AuthorizationUrl = document.AuthorizationEndpoint
+	}
+	if provider.TokenUrl == "" {
+		provider.TokenUrl = document.TokenEndpoint
+	}
+	if provider.UserInfoUrl == "" {
+		provider.UserInfoUrl = document.UserinfoEndpoint
+	}
+	provider.discovered = true
+	return nil
+}
+
+// oauthAuthorizeUrl returns the url of the provider where the user logs in. The state is a signed token, so the
+// callback does not need to keep server side sessions
+func (app *WeStack) oauthAuthorizeUrl(loadedModel *model.Model, name string, ctx *fiber.Ctx) (string, error) {
+	provider, err := app.findOAuthProvider(name)
+	if err != nil {
+		return "", err
+	}
+	successRedirect := provider.SuccessRedirect
+	if requested := ctx.Query("redirect"); requested != "" {
+		if !provider.isAllowedRedirect(requested) {
+			return "", wst.CreateError(fiber.ErrBadRequest, "INVALID_REDIRECT", fiber.Map{"message": "redirect is not allowed"}, "ValidationError")
+		}
+		successRedirect = requested
+	}
+	verifier, err := oauthCodeVerifier()
+	if err != nil {
+		return "", err
+	}
+	stateId := uuid.New().String()
+	expiresAt := time.Now().Add(oauthStateTtl)
+	state, err := app.signToken(jwt.MapClaims{
+		"type":     "oauth_state",
+		"provider": name,
+		"jti":      stateId,
+		"redirect": successRedirect,
+		"exp":      expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	for cookieName, value := range map[string]string{oauthStateCookie: stateId, oauthVerifierCookie: verifier} {
+		ctx.Cookie(&fiber.Cookie{
+			Name:     cookieName,
+			Value:    value,
+			Path:     loadedModel.BaseUrl + "/auth/" + name,
+			Expires:  expiresAt,
+			HTTPOnly: true,
+			Secure:   ctx.Protocol() == "https",
+			SameSite: "Lax",
+		})
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	scopes := provider.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.ClientId},
+		"redirect_uri":          {provider.RedirectUrl},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationUrl, "?") {
+		separator = "&"
+	}
+	return provider.AuthorizationUrl + separator + query.Encode(), nil
+}
+
+// oauthCodeVerifier returns a random PKCE code verifier, 43 characters long
+func oauthCodeVerifier() (string, error) {
+	buffer := make([]byte, 32)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buffer), nil
+}
+
+/*
+oauthCallback completes the login at the provider: it checks the state, exchanges the code for an access token, reads
+the profile of the user and links it to a user. The result is the same as POST /<users>/login, including the MFA
+challenge, and the successRedirect chosen at the login, if any
+*/
+func (app *WeStack) oauthCallback(loadedModel *model.Model, name string, ctx *model.EventContext) (fiber.Map, string, error) {
+	provider, err := app.findOAuthProvider(name)
+	if err != nil {
+		return nil, "", err
+	}
+	c := ctx.Ctx
+	if providerError := c.Query("error"); providerError != "" {
+		return nil, "", wst.CreateError(fiber.ErrUnauthorized, "OAUTH_FAILED", fiber.Map{"message": fmt.Sprintf("%v: %v", providerError, c.Query("error_description"))}, "Error")
+	}
+	verifier := c.Cookies(oauthVerifierCookie)
+	stateClaims, err := app.parseToken(c.Query("state"))
+	if err != nil || stateClaims["type"] != "oauth_state" || stateClaims["provider"] != name || stateClaims["jti"] != c.Cookies(oauthStateCookie) || verifier == "" {
+		return nil, "", wst.CreateError(fiber.ErrUnauthorized, "INVALID_OAUTH_STATE", fiber.Map{"message": "invalid or expired state"}, "Error")
+	}
+	for _, cookieName := range []string{oauthStateCookie, oauthVerifierCookie} {
+		c.Cookie(&fiber.Cookie{Name: cookieName, Path: loadedModel.BaseUrl + "/auth/" + name, Expires: time.Unix(0, 0), HTTPOnly: true})
+	}
+	successRedirect, _ := stateClaims["redirect"].(string)
+	if successRedirect != "" && !provider.isAllowedRedirect(successRedirect) {
+		return nil, "", wst.CreateError(fiber.ErrBadRequest, "INVALID_REDIRECT", fiber.Map{"message": "redirect is not allowed"}, "ValidationError")
+	}
+	code := c.Query("code")
+	if code == "" {
+		return nil, "", wst.CreateError(fiber.ErrBadRequest, "OAUTH_CODE_REQUIRED", fiber.Map{"message": "code is required"}, "ValidationError")
+	}
+
+	var providerTokens struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = oauthRequest("POST", provider.TokenUrl, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"code_verifier": {verifier},
+		"redirect_uri":  {provider.RedirectUrl},
+		"client_id":     {provider.ClientId},
+		"client_secret": {provider.ClientSecret},
+	}, "", &providerTokens)
+	if err != nil || providerTokens.AccessToken == "" {
+		log.Printf("ERROR: Could not exchange the code of %v: %v\n", name, err)
+		return nil, "", wst.CreateError(fiber.ErrUnauthorized, "OAUTH_FAILED", fiber.Map{"message": "could not exchange the code"}, "Error")
+	}
+
+	var profile wst.M
+	err = oauthRequest("GET", provider.UserInfoUrl, nil, providerTokens.AccessToken, &profile)
+	if err != nil {
+		log.Printf("ERROR: Could not read the profile from %v: %v\n", name, err)
+		return nil, "", wst.CreateError(fiber.ErrUnauthorized, "OAUTH_FAILED", fiber.Map{"message": "could not read the profile"}, "Error")
+	}
+
+	userId, err := app.linkIdentity(loadedModel, name, profile, ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	user, err := loadedModel.FindById(userId, nil, systemContext())
+	if err != nil {
+		return nil, "", err
+	}
+	if user == nil {
+		return nil, "", wst.CreateError(fiber.ErrUnauthorized, "OAUTH_FAILED", fiber.Map{"message": "user not found"}, "Error")
+	}
+	tokens, err := app.completeLogin(user, ctx)
+	return tokens, successRedirect, err
+}
+
+/*
+linkIdentity returns the user of the external profile, in this order:
+  - the user already linked to the profile in UserIdentity
+  - the user with the same email, if the provider verified it
+  - a new user with the email of the profile and a random password
+*/
+func (app *WeStack) linkIdentity(loadedModel *model.Model, provider string, profile wst.M, ctx *model.EventContext) (primitive.ObjectID, error) {
+	externalId := fmt.Sprintf("%v", profile["sub"])
+	if profile["sub"] == nil {
+		if profile["id"] == nil {
+			return primitive.NilObjectID, wst.CreateError(fiber.ErrUnauthorized, "OAUTH_FAILED", fiber.Map{"message": "the profile has no sub"}, "Error")
+		}
+		externalId = fmt.Sprintf("%v", profile["id"])
+	}
+
+	identities, err := app.userIdentityModel.FindMany(&wst.Filter{Where: &wst.Where{"provider": provider, "externalId": externalId}}, systemContext())
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if len(identities) > 0 {
+		identity := identities[0]
+		userId, err := toObjectID(identity.ToJSON()["userId"])
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		_, err = identity.UpdateAttributes(wst.M{"profile": profile}, systemContext())
+		return userId, err
+	}
+
+	email, _ := profile["email"].(string)
+	if strings.TrimSpace(email) == "" {
+		return primitive.NilObjectID, wst.CreateError(fiber.ErrBadRequest, "OAUTH_EMAIL_REQUIRED", fiber.Map{"message": "the provider did not share the email"}, "ValidationError")
+	}
+	var userId primitive.ObjectID
+	existent, err := findByIdentifier(loadedModel, "email", email, nil)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if existent != nil {
+		// Linking by email would let anyone that can register that email at the provider take over the account
+		if profile["email_verified"] != true {
+			return primitive.NilObjectID, wst.CreateError(fiber.ErrConflict, "EMAIL_UNIQUENESS", fiber.Map{"message": "an account with this email already exists"}, "ValidationError")
+		}
+		userId = existent.Id.(primitive.ObjectID)
+	} else {
+		userData := wst.M{"email": email, "password": uuid.New().String()}
+		if profile["email_verified"] == true {
+			userData["emailVerified"] = true
+		}
+		created, err := loadedModel.Create(userData, &model.EventContext{BaseContext: systemContext(), Ctx: ctx.Ctx, SkipFieldProtection: true})
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		userId = created.Id.(primitive.ObjectID)
+	}
+
+	_, err = app.userIdentityModel.Create(wst.M{
+		"provider":   provider,
+		"externalId": externalId,
+		"userId":     userId,
+		"profile":    profile,
+	}, systemContext())
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return userId, nil
+}
+
+func toObjectID(id interface{}) (primitive.ObjectID, error) {
+	switch id.(type) {
+	case primitive.ObjectID:
+		return id.(primitive.ObjectID), nil
+	case string:
+		return primitive.ObjectIDFromHex(id.(string))
+	}
+	return primitive.NilObjectID, fmt.Errorf("invalid id %v", id)
+}
+
+// oauthRequest sends form to targetUrl, or a GET without form, and decodes the JSON response into result
+func oauthRequest(method string, targetUrl string, form url.Values, bearer string, result interface{}) error {
+	var request *http.Request
+	var err error
+	if form != nil {
+		request, err = http.NewRequest(method, targetUrl, strings.NewReader(form.Encode()))
+		if err == nil {
+			request.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+		}
+	} else {
+		request, err = http.NewRequest(method, targetUrl, nil)
+	}
+	if err != nil {
+		return err
+	}
+	request.Header.Set(fiber.HeaderAccept, fiber.MIMEApplicationJSON)
+	if bearer != "" {
+		request.Header.Set(fiber.HeaderAuthorization, "Bearer "+bearer)
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v %v responded %v: %v", method, targetUrl, response.StatusCode, string(body))
+	}
+	return json.Unmarshal(body, result)
+}
+
+// oauthSuccessUrl adds the tokens to the fragment of the SuccessRedirect url of the provider
+func oauthSuccessUrl(successRedirect string, tokens fiber.Map) string {
+	fragment := url.Values{}
+	for key, value := range tokens {
+		fragment.Set(key, fmt.Sprintf("%v", value))
+	}
+	return successRedirect + "#" + fragment.Encode()
+}
@@ -0,0 +1,153 @@
+package westack
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+const defaultResetPasswordTtl = time.Hour
+
+// resetPasswordTtl returns the lifetime of reset tokens, set in seconds with resetPassword.ttl in config.json
+func (app *WeStack) resetPasswordTtl() time.Duration {
+	if seconds := app.viper.GetInt64("resetPassword.ttl"); seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultResetPasswordTtl
+}
+
+// resetPasswordUrl returns resetPassword.url in config.json, or <publicUrl>/reset-password. It panics without both
+func (app *WeStack) resetPasswordUrl() string {
+	resetUrl := app.viper.GetString("resetPassword.url")
+	if resetUrl == "" {
+		if app.publicUrl() == "" {
+			panic("resetPassword.url or publicUrl is required in config.json to send the reset password links")
+		}
+		return app.publicUrl() + "/reset-password"
+	}
+	if !isAbsoluteUrl(resetUrl) {
+		panic(fmt.Sprintf("invalid resetPassword.url %v", resetUrl))
+	}
+	return resetUrl
+}
+
+/*
+requestPasswordReset creates a reset token for the user with the given email, and passes it to the
+sendResetPasswordEmail handler in the Data of its context. Without handler, the reset-password template is sent with
+the mail datasource, if there is one:
+  - email: the stored email of the user
+  - token: valid once, for resetPassword.ttl seconds
+  - link: resetPasswordUrl() with the token in the query, like https://app.example.com/reset?token=...
+
+Nothing is sent when the email does not exist, and the response is the same so emails cannot be enumerated
+*/
+func (app *WeStack) requestPasswordReset(loadedModel *model.Model, ctx *model.EventContext) error {
+	email, _ := (*ctx.Data)["email"].(string)
+	if strings.TrimSpace(email) == "" {
+		return wst.CreateError(fiber.ErrBadRequest, "EMAIL_PRESENCE", fiber.Map{"message": "Invalid email", "codes": wst.M{"email": []string{"presence"}}}, "ValidationError")
+	}
+	user, err := findByIdentifier(loadedModel, "email", email, realmOf(loadedModel, *ctx.Data))
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		if app.debug {
+			log.Println("No user found to reset the password of", email)
+		}
+		return nil
+	}
+	userId := user.Id.(primitive.ObjectID)
+
+	expiresAt := time.Now().Add(app.resetPasswordTtl())
+	jti := uuid.New().String()
+	token, err := app.signToken(jwt.MapClaims{
+		"userId": userId.Hex(),
+		"type":   "reset",
+		"jti":    jti,
+		"exp":    expiresAt.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	err = app.storeToken(wst.M{"userId": userId}, "reset", jti, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	resetUrl := app.resetPasswordUrl()
+	separator := "?"
+	if strings.Contains(resetUrl, "?") {
+		separator = "&"
+	}
+	notifierContext := &model.EventContext{
+		BaseContext: ctx,
+		Ctx:         ctx.Ctx,
+		Instance:    user,
+		Data: &wst.M{
+			"email": user.GetString("email"),
+			"token": token,
+			"link":  resetUrl + separator + "token=" + url.QueryEscape(token),
+		},
+	}
+	if loadedModel.HasHandler("sendResetPasswordEmail") || app.mailDatasource() == nil {
+		err = loadedModel.GetHandler("sendResetPasswordEmail")(notifierContext)
+	} else {
+		err = app.sendResetPasswordMail(notifierContext)
+	}
+	if err != nil {
+		log.Println("ERROR: sendResetPasswordEmail:", err)
+	}
+	return nil
+}
+
+// confirmPasswordReset sets the new password of the user of a reset token, and revokes every stored token of the user
+func (app *WeStack) confirmPasswordReset(loadedModel *model.Model, ctx *model.EventContext) error {
+	invalidTokenErr := wst.CreateError(fiber.ErrUnauthorized, "INVALID_RESET_TOKEN", fiber.Map{"message": "invalid or expired reset token"}, "Error")
+
+	rawToken, _ := (*ctx.Data)["token"].(string)
+	password, _ := (*ctx.Data)["password"].(string)
+	if strings.TrimSpace(password) == "" {
+		return wst.CreateError(fiber.ErrBadRequest, "PASSWORD_BLANK", fiber.Map{"message": "Invalid password"}, "ValidationError")
+	}
+	claims, err := app.parseToken(rawToken)
+	if err != nil || claims["type"] != "reset" {
+		return invalidTokenErr
+	}
+	userIdHex, _ := claims["userId"].(string)
+	userId, err := primitive.ObjectIDFromHex(userIdHex)
+	if err != nil {
+		return invalidTokenErr
+	}
+
+	storedToken, err := app.claimStoredToken(claims["jti"], "reset")
+	if err != nil {
+		return err
+	}
+	if storedToken == nil {
+		return invalidTokenErr
+	}
+
+	user, err := loadedModel.FindById(userId, nil, systemContext())
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return invalidTokenErr
+	}
+	// The password is hashed by the before_save handler of User models
+	_, err = user.UpdateAttributes(wst.M{"password": password}, &model.EventContext{BaseContext: systemContext(), SkipFieldProtection: true})
+	if err != nil {
+		return err
+	}
+	return app.revokeTokens(wst.Where{"userId": userId})
+}
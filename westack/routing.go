@@ -1,16 +1,18 @@
 package westack
 
 import (
-	"errors"
+	"bufio"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
-	"time"
 
 	"github.com/casbin/casbin/v2"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt"
+	"github.com/gofiber/fiber/v2/utils"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	wst "github.com/fredyk/westack-go/westack/common"
@@ -165,6 +167,21 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			panic(err)
 		}
 
+		_, err = e.AddRoleForUser("aggregate", replaceVarNames("read"))
+		if err != nil {
+			panic(err)
+		}
+		_, err = e.AddRoleForUser("search", replaceVarNames("read"))
+		if err != nil {
+			panic(err)
+		}
+		for scopeName := range loadedModel.Config.Scopes {
+			_, err = e.AddRoleForUser(fmt.Sprintf("__scope__%v", scopeName), replaceVarNames("read"))
+			if err != nil {
+				panic(err)
+			}
+		}
+
 		_, err = e.AddRoleForUser("create", replaceVarNames("write"))
 		if err != nil {
 			panic(err)
@@ -177,6 +194,18 @@ func (app *WeStack) loadModelsFixedRoutes() {
 		if err != nil {
 			panic(err)
 		}
+		for propertyName, property := range loadedModel.Config.Properties {
+			for _, operator := range property.UpdateOperators {
+				if !model.SupportedUpdateOperators[operator] {
+					panic(fmt.Sprintf("Unsupported update operator %v for %v.%v", operator, loadedModel.Name, propertyName))
+				}
+				_, err = e.AddRoleForUser(model.UpdateOperatorAction(operator, propertyName), replaceVarNames("write"))
+				if err != nil {
+					panic(err)
+				}
+			}
+		}
+		// instance_restore and instance_purge are not part of write, they need their own policies
 
 		_, err = e.AddRoleForUser("read", replaceVarNames("*"))
 		if err != nil {
@@ -268,6 +297,104 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			},
 		})
 
+		if app.debug {
+			log.Println("Mount GET " + loadedModel.BaseUrl + "/aggregate")
+		}
+		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+			return handleEvent(eventContext, loadedModel, "aggregate")
+		}, model.RemoteMethodOptions{
+			Name:        "aggregate",
+			Description: fmt.Sprintf("Groups %v and computes metrics for every group.", loadedModel.Config.Plural),
+			Accepts: model.RemoteMethodOptionsHttpArgs{
+				{
+					Arg:         "where",
+					Type:        "string",
+					Description: "JSON where clause",
+					Http:        model.ArgHttp{Source: "query"},
+					Required:    false,
+				},
+				{
+					Arg:         "groupBy",
+					Type:        "string",
+					Description: "Comma separated properties. Dates accept a bucket: created:day (hour, day, week, month, year)",
+					Http:        model.ArgHttp{Source: "query"},
+					Required:    false,
+				},
+				{
+					Arg:         "metrics",
+					Type:        "string",
+					Description: "Comma separated metrics: count, sum:<property>, avg:<property>, min:<property>, max:<property>",
+					Http:        model.ArgHttp{Source: "query"},
+					Required:    false,
+				},
+			},
+			Http: model.RemoteMethodOptionsHttp{
+				Path: "/aggregate",
+				Verb: "get",
+			},
+		})
+
+		if app.debug {
+			log.Println("Mount GET " + loadedModel.BaseUrl + "/search")
+		}
+		loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+			return handleEvent(eventContext, loadedModel, "search")
+		}, model.RemoteMethodOptions{
+			Name:        "search",
+			Description: fmt.Sprintf("Finds %v matching a full-text search, sorted by relevance.", loadedModel.Config.Plural),
+			Accepts: model.RemoteMethodOptionsHttpArgs{
+				{
+					Arg:         "q",
+					Type:        "string",
+					Description: "Text to search in the properties with \"textIndex\": true",
+					Http:        model.ArgHttp{Source: "query"},
+					Required:    true,
+				},
+				{
+					Arg:         "filter",
+					Type:        "string",
+					Description: "",
+					Http:        model.ArgHttp{Source: "query"},
+					Required:    false,
+				},
+			},
+			Http: model.RemoteMethodOptionsHttp{
+				Path: "/search",
+				Verb: "get",
+			},
+		})
+
+		scopeNames := make([]string, 0, len(loadedModel.Config.Scopes))
+		for scopeName := range loadedModel.Config.Scopes {
+			scopeNames = append(scopeNames, scopeName)
+		}
+		sort.Strings(scopeNames)
+		for _, scopeName := range scopeNames {
+			scopeEvent := fmt.Sprintf("__scope__%v", scopeName)
+			if app.debug {
+				log.Println("Mount GET " + loadedModel.BaseUrl + "/scopes/" + scopeName)
+			}
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, scopeEvent)
+			}, model.RemoteMethodOptions{
+				Name:        scopeEvent,
+				Description: fmt.Sprintf("Finds %v in the scope %v.", loadedModel.Config.Plural, scopeName),
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "filter",
+						Type:        "string",
+						Description: "",
+						Http:        model.ArgHttp{Source: "query"},
+						Required:    false,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/scopes/" + scopeName,
+					Verb: "get",
+				},
+			})
+		}
+
 		if loadedModel.Config.Base == "User" {
 
 			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
@@ -291,6 +418,75 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			},
 			)
 
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "refresh")
+			}, model.RemoteMethodOptions{
+				Name:        "refresh",
+				Description: "Exchanges a refresh token for a new access token and refresh token",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "{\"refreshToken\": \"...\"}",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/refresh",
+					Verb: "post",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "oauthLogin")
+			}, model.RemoteMethodOptions{
+				Name:        "oauthLogin",
+				Description: "Redirects to the login page of an OAuth2 or OpenID Connect provider",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/auth/:provider",
+					Verb: "get",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "oauthCallback")
+			}, model.RemoteMethodOptions{
+				Name:        "oauthCallback",
+				Description: "Completes the login at an OAuth2 or OpenID Connect provider and returns the same tokens as login",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/auth/:provider/callback",
+					Verb: "get",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "logout")
+			}, model.RemoteMethodOptions{
+				Name:        "logout",
+				Description: "Revokes the tokens of the current session",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/logout",
+					Verb: "post",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "logoutAll")
+			}, model.RemoteMethodOptions{
+				Name:        "logoutAll",
+				Description: "Revokes the tokens of every session of the user",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/logout-all",
+					Verb: "post",
+				},
+			},
+			)
+
 			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
 
 				err, token := eventContext.GetBearer(loadedModel)
@@ -321,14 +517,143 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			},
 			)
 
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "changePassword")
+			}, model.RemoteMethodOptions{
+				Name:        "changePassword",
+				Description: "Changes the password of the user with their bearer, and logs out their other sessions",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "{\"oldPassword\": \"...\", \"newPassword\": \"...\"}",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/change-password",
+					Verb: "post",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "changeEmail")
+			}, model.RemoteMethodOptions{
+				Name:        "changeEmail",
+				Description: "Changes the email of the user with their bearer, and sends a verification email to the new one",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "{\"email\": \"...\", \"password\": \"...\"}",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/change-email",
+					Verb: "post",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "deleteSelf")
+			}, model.RemoteMethodOptions{
+				Name:        "deleteSelf",
+				Description: "Deletes the user with their bearer and the data related with onDelete",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/me",
+					Verb: "delete",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "mfaSetup")
+			}, model.RemoteMethodOptions{
+				Name:        "mfaSetup",
+				Description: "Creates a TOTP secret for the user with their bearer, and returns its otpauth:// uri",
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/mfa/setup",
+					Verb: "post",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "mfaVerify")
+			}, model.RemoteMethodOptions{
+				Name:        "mfaVerify",
+				Description: "Enables MFA with a code of the secret from mfa/setup, and returns the recovery codes",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "{\"code\": \"123456\"}",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/mfa/verify",
+					Verb: "post",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "mfaDisable")
+			}, model.RemoteMethodOptions{
+				Name:        "mfaDisable",
+				Description: "Disables MFA for the user with their bearer",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "{\"password\": \"...\", \"code\": \"123456\"}",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/mfa/disable",
+					Verb: "post",
+				},
+			},
+			)
+
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				return handleEvent(eventContext, loadedModel, "loginMfa")
+			}, model.RemoteMethodOptions{
+				Name:        "loginMfa",
+				Description: "Completes a login of a user with MFA, with the challenge token and a code or a recovery code",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "{\"challengeToken\": \"...\", \"code\": \"123456\"}",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/login/mfa",
+					Verb: "post",
+				},
+			},
+			)
+
 			if app.debug {
 				log.Println("Mount POST " + loadedModel.BaseUrl + "/reset-password")
 			}
 			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
-				// Developer must implement this event
-				return handleEvent(eventContext, loadedModel, "sendResetPasswordEmail")
+				return handleEvent(eventContext, loadedModel, "resetPassword")
 			}, model.RemoteMethodOptions{
-				Name: "resetPassword",
+				Name:        "resetPassword",
+				Description: "Sends a link to reset the password to the email of the user",
 				Accepts: model.RemoteMethodOptionsHttpArgs{
 					{
 						Arg:         "data",
@@ -344,21 +669,39 @@ func (app *WeStack) loadModelsFixedRoutes() {
 				},
 			})
 
+			if app.debug {
+				log.Println("Mount POST " + loadedModel.BaseUrl + "/reset-password/confirm")
+			}
 			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
-				fmt.Println("verify user ", eventContext.Bearer.User.Id)
-				eventContext.Bearer.Claims["created"] = time.Now().Unix()
-				eventContext.Bearer.Claims["ttl"] = 86400 * 2 * 1000
-				eventContext.Bearer.Claims["allowsEmailVerification"] = true
-
-				token := jwt.NewWithClaims(jwt.SigningMethodHS256, eventContext.Bearer.Claims)
+				return handleEvent(eventContext, loadedModel, "resetPasswordConfirm")
+			}, model.RemoteMethodOptions{
+				Name:        "resetPasswordConfirm",
+				Description: "Sets a new password with the token of the reset link",
+				Accepts: model.RemoteMethodOptionsHttpArgs{
+					{
+						Arg:         "data",
+						Type:        "object",
+						Description: "{\"token\": \"...\", \"password\": \"...\"}",
+						Http:        model.ArgHttp{Source: "body"},
+						Required:    true,
+					},
+				},
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/reset-password/confirm",
+					Verb: "post",
+				},
+			})
 
-				tokenString, err := token.SignedString(loadedModel.App.JwtSecretKey)
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				user, err := app.currentUser(loadedModel, eventContext)
 				if err != nil {
 					return err
 				}
-				eventContext.Bearer.Raw = tokenString
-
-				return handleEvent(eventContext, loadedModel, "sendVerificationEmail")
+				err = app.sendEmailVerification(loadedModel, user, eventContext)
+				if err != nil {
+					return err
+				}
+				return eventContext.Ctx.SendStatus(fiber.StatusNoContent)
 			}, model.RemoteMethodOptions{
 				Name: "sendVerificationEmail",
 				Accepts: model.RemoteMethodOptionsHttpArgs{
@@ -377,36 +720,22 @@ func (app *WeStack) loadModelsFixedRoutes() {
 			})
 
 			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
-				// Developer must implement this event
-				userId := eventContext.Bearer.User.Id
-				if userId == "" {
-					return errors.New("no user id found in bearer")
+				if loadedModel.HasHandler("performEmailVerification") {
+					return handleEvent(eventContext, loadedModel, "performEmailVerification")
 				}
-				if eventContext.Bearer.Claims["allowsEmailVerification"] == true {
-					user, err := loadedModel.FindById(userId, nil, eventContext)
-					if err != nil {
-						return err
-					}
-					eventContext.SkipFieldProtection = true
-					updated, err := user.UpdateAttributes(wst.M{
-						"emailVerified": true,
-					}, eventContext)
-					if err != nil {
-						return err
-					}
-					if app.debug {
-						log.Println("Updated user ", updated)
-					}
-					redirectToUrl := eventContext.Ctx.Query("redirect_uri")
-					return eventContext.Ctx.Redirect(redirectToUrl)
+				err := app.verifyEmail(loadedModel, eventContext.Ctx.Query("token"))
+				if err != nil {
+					return err
 				}
-
-				return handleEvent(eventContext, loadedModel, "performEmailVerification")
+				if redirectUrl := app.viper.GetString("verifyEmail.redirectUrl"); redirectUrl != "" {
+					return eventContext.Ctx.Redirect(redirectUrl)
+				}
+				return eventContext.Ctx.SendStatus(fiber.StatusNoContent)
 			}, model.RemoteMethodOptions{
 				Name: "performEmailVerification",
 				Accepts: model.RemoteMethodOptionsHttpArgs{
 					{
-						Arg:         "access_token",
+						Arg:         "token",
 						Type:        "string",
 						Description: "",
 						Http:        model.ArgHttp{Source: "query"},
@@ -514,7 +843,127 @@ func (app *WeStack) loadModelsDynamicRoutes() {
 				Verb: "delete",
 			},
 		})
+
+		if loadedModel.Config.Audit {
+			if app.debug {
+				log.Println("Mount GET " + loadedModel.BaseUrl + "/:id/history")
+			}
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
+				if err != nil {
+					return err
+				}
+				eventContext.ModelID = &id
+				return handleEvent(eventContext, loadedModel, "instance_history")
+			}, model.RemoteMethodOptions{
+				Name:        "instance_history",
+				Description: fmt.Sprintf("Finds the changes made to a %v, newest first.", loadedModel.Name),
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/:id/history",
+					Verb: "get",
+				},
+			})
+		}
+		if loadedModel.Config.SoftDelete {
+			if app.debug {
+				log.Println("Mount POST " + loadedModel.BaseUrl + "/:id/restore")
+			}
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
+				if err != nil {
+					return err
+				}
+				eventContext.ModelID = &id
+				return handleEvent(eventContext, loadedModel, "instance_restore")
+			}, model.RemoteMethodOptions{
+				Name:        "instance_restore",
+				Description: fmt.Sprintf("Restores a deleted %v.", loadedModel.Name),
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/:id/restore",
+					Verb: "post",
+				},
+			})
+
+			if app.debug {
+				log.Println("Mount DELETE " + loadedModel.BaseUrl + "/:id/purge")
+			}
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
+				if err != nil {
+					return err
+				}
+				eventContext.ModelID = &id
+				return handleEvent(eventContext, loadedModel, "instance_purge")
+			}, model.RemoteMethodOptions{
+				Name:        "instance_purge",
+				Description: fmt.Sprintf("Removes a %v permanently.", loadedModel.Name),
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/:id/purge",
+					Verb: "delete",
+				},
+			})
+		}
+		if loadedModel.Config.Base == "User" {
+			if app.debug {
+				log.Println("Mount GET " + loadedModel.BaseUrl + "/:id/sessions")
+			}
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
+				if err != nil {
+					return err
+				}
+				err = enforceWithoutOwnership(loadedModel, eventContext, "instance_sessions")
+				if err != nil {
+					return err
+				}
+				eventContext.ModelID = &id
+				return handleEvent(eventContext, loadedModel, "instance_sessions")
+			}, model.RemoteMethodOptions{
+				Name:        "instance_sessions",
+				Description: fmt.Sprintf("Finds the active sessions of a %v.", loadedModel.Name),
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/:id/sessions",
+					Verb: "get",
+				},
+			})
+
+			if app.debug {
+				log.Println("Mount DELETE " + loadedModel.BaseUrl + "/:id/sessions/:sessionId")
+			}
+			loadedModel.RemoteMethod(func(eventContext *model.EventContext) error {
+				id, err := primitive.ObjectIDFromHex(eventContext.Ctx.Params("id"))
+				if err != nil {
+					return err
+				}
+				err = enforceWithoutOwnership(loadedModel, eventContext, "instance_revokeSession")
+				if err != nil {
+					return err
+				}
+				eventContext.ModelID = &id
+				return handleEvent(eventContext, loadedModel, "instance_revokeSession")
+			}, model.RemoteMethodOptions{
+				Name:        "instance_revokeSession",
+				Description: fmt.Sprintf("Revokes the tokens of a session of a %v.", loadedModel.Name),
+				Http: model.RemoteMethodOptionsHttp{
+					Path: "/:id/sessions/:sessionId",
+					Verb: "delete",
+				},
+			})
+		}
+	}
+}
+
+// enforceWithoutOwnership checks action for any instance, so it is not allowed by $owner policies like the default
+// "$owner,*,*,allow" of User models. It is used by the admin endpoints that take the id of a user
+func enforceWithoutOwnership(loadedModel *model.Model, eventContext *model.EventContext, action string) error {
+	err, allowed := loadedModel.EnforceEx(eventContext.Bearer, "*", action, eventContext)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fiber.ErrUnauthorized
 	}
+	return nil
 }
 
 func handleEvent(eventContext *model.EventContext, loadedModel *model.Model, event string) error {
@@ -524,6 +973,10 @@ func handleEvent(eventContext *model.EventContext, loadedModel *model.Model, eve
 			return err
 		}
 	}
+	if eventContext.Ctx.Response().IsBodyStream() {
+		// The handler is already writing the response
+		return nil
+	}
 	if eventContext.StatusCode == 0 {
 		eventContext.StatusCode = fiber.StatusNotImplemented
 	}
@@ -534,3 +987,54 @@ func handleEvent(eventContext *model.EventContext, loadedModel *model.Model, eve
 	}
 	return eventContext.Ctx.Status(eventContext.StatusCode).JSON(eventContext.Result)
 }
+
+const ndjsonContentType = "application/x-ndjson"
+
+// streamFindMany writes the results of the findMany filter as newline delimited JSON, one instance per line, so
+// large exports are not loaded in memory. Errors found once the response has started are written as a last line
+// with an "error" key, because the status code is already sent.
+func streamFindMany(loadedModel *model.Model, ctx *model.EventContext) error {
+	// The writer runs after this handler returns, once fiber has released ctx.Ctx, so it only gets copies
+	streamContext := &model.EventContext{
+		Bearer:                 copyBearer(ctx.Bearer),
+		Filter:                 ctx.Filter,
+		DisableTypeConversions: ctx.DisableTypeConversions,
+	}
+	ctx.Ctx.Status(fiber.StatusOK).Set(fiber.HeaderContentType, ndjsonContentType)
+	ctx.Ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		cursorContext, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		err := loadedModel.FindEach(cursorContext, streamContext.Filter, streamContext, func(instance *model.Instance) error {
+			instance.HideProperties()
+			bytes, err := json.Marshal(instance.ToJSON())
+			if err == nil {
+				_, err = w.Write(append(bytes, '\n'))
+			}
+			if err == nil {
+				err = w.Flush()
+			}
+			if err != nil {
+				// Most likely the client is gone, so the cursor is not read anymore
+				cancel()
+			}
+			return err
+		})
+		if err != nil {
+			log.Printf("Error while streaming %v.findMany: %v\n", loadedModel.Name, err)
+			bytes, _ := json.Marshal(fiber.Map{"error": fiber.Map{"message": err.Error()}})
+			_, _ = w.Write(append(bytes, '\n'))
+			_ = w.Flush()
+		}
+	})
+	ctx.StatusCode = fiber.StatusOK
+	return nil
+}
+
+func copyBearer(bearer *model.BearerToken) *model.BearerToken {
+	if bearer == nil {
+		return nil
+	}
+	bearerCopy := *bearer
+	bearerCopy.Raw = utils.CopyString(bearer.Raw)
+	return &bearerCopy
+}
@@ -2,17 +2,33 @@ package tests
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"github.com/fredyk/westack-go/westack"
 	wst "github.com/fredyk/westack-go/westack/common"
+	"github.com/fredyk/westack-go/westack/datasource"
+	"github.com/fredyk/westack-go/westack/model"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"io"
 	"log"
 	"math/big"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -20,7 +36,7 @@ import (
 var app *westack.WeStack
 
 func init() {
-	app = westack.New(westack.Options{})
+	app = westack.New(westack.Options{JwtSecretKey: "westack-tests-secret"})
 	app.Boot(func(app *westack.WeStack) {
 
 	})
@@ -138,3 +154,1312 @@ func Test_WeStackDelete(t *testing.T) {
 	}
 
 }
+
+func postJSON(t *testing.T, path string, body wst.M) (int, wst.M) {
+	request := httptest.NewRequest("POST", path, createBody(t, body))
+	request.Header.Set("Content-Type", "application/json")
+	response, err := app.Server.Test(request)
+	if err != nil {
+		t.Error(err)
+		return 0, nil
+	}
+	var result wst.M
+	responseBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Error(err)
+		return 0, nil
+	}
+	_ = json.Unmarshal(responseBytes, &result)
+	return response.StatusCode, result
+}
+
+// invokeJSON sends body, if any, with the bearer token, if any, and returns the response with its body
+func invokeJSON(t *testing.T, method string, path string, token string, body interface{}, headers ...string) (*http.Response, []byte) {
+	var reader io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			t.Error(err)
+			return nil, nil
+		}
+		reader = bytes.NewReader(bodyBytes)
+	}
+	request := httptest.NewRequest(method, path, reader)
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	for idx := 0; idx+1 < len(headers); idx += 2 {
+		request.Header.Set(headers[idx], headers[idx+1])
+	}
+	response, err := app.Server.Test(request, -1)
+	if err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	responseBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	return response, responseBytes
+}
+
+// newSession creates a user with a random email and logs in, returning the email, the access token and the user id
+func newSession(t *testing.T) (string, string, string) {
+	n, _ := rand.Int(rand.Reader, big.NewInt(899999999))
+	email := fmt.Sprintf("email%v@example.com", 100000000+n.Int64())
+	body := wst.M{"email": email, "password": "test"}
+	createUser(t, createBody(t, body))
+	token, userId := login(t, createBody(t, body))
+	return email, token, userId
+}
+
+// findJSON runs GET path with filter and returns the status and the decoded array
+func findJSON(t *testing.T, path string, token string, filter wst.M) (int, []wst.M) {
+	filterBytes, _ := json.Marshal(filter)
+	response, responseBytes := invokeJSON(t, "GET", path+"?filter="+url.QueryEscape(string(filterBytes)), token, nil)
+	if response == nil {
+		return 0, nil
+	}
+	var result []wst.M
+	_ = json.Unmarshal(responseBytes, &result)
+	return response.StatusCode, result
+}
+
+// createJSON runs POST path with body and returns the created instance
+func createJSON(t *testing.T, path string, token string, body wst.M) wst.M {
+	response, responseBytes := invokeJSON(t, "POST", path, token, body)
+	if response == nil || !assert.Equal(t, 200, response.StatusCode, string(responseBytes)) {
+		return wst.M{}
+	}
+	var result wst.M
+	_ = json.Unmarshal(responseBytes, &result)
+	return result
+}
+
+func Test_WeStackRefreshToken(t *testing.T) {
+
+	email, _, _ := newSession(t)
+	status, loginResponse := postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "test"})
+	if !assert.Equal(t, 200, status) || !assert.NotEmpty(t, loginResponse["refreshToken"]) {
+		return
+	}
+
+	status, refreshed := postJSON(t, "/api/v1/users/refresh", wst.M{"refreshToken": loginResponse["refreshToken"]})
+	if !assert.Equal(t, 200, status) {
+		return
+	}
+	assert.NotEmpty(t, refreshed["id"])
+	assert.NotEqual(t, loginResponse["refreshToken"], refreshed["refreshToken"])
+
+	// Refresh tokens can only be used once
+	status, _ = postJSON(t, "/api/v1/users/refresh", wst.M{"refreshToken": loginResponse["refreshToken"]})
+	assert.Equal(t, 401, status)
+
+	// Also when they are used concurrently
+	status, loginResponse = postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "test"})
+	if !assert.Equal(t, 200, status) {
+		return
+	}
+	var mutex sync.Mutex
+	refreshed200 := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, _ := postJSON(t, "/api/v1/users/refresh", wst.M{"refreshToken": loginResponse["refreshToken"]})
+			if status == 200 {
+				mutex.Lock()
+				refreshed200++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, refreshed200)
+
+}
+
+func Test_WeStackOAuthLogin(t *testing.T) {
+
+	n, _ := rand.Int(rand.Reader, big.NewInt(899999999))
+	email := fmt.Sprintf("email%v@example.com", 100000000+n.Int64())
+
+	// Local mock of an OpenID Connect provider
+	mux := http.NewServeMux()
+	mockServer := httptest.NewServer(mux)
+	defer mockServer.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(wst.M{
+			"authorization_endpoint": mockServer.URL + "/authorize",
+			"token_endpoint":         mockServer.URL + "/token",
+			"userinfo_endpoint":      mockServer.URL + "/userinfo",
+		})
+	})
+	// PKCE challenge of the last login, the token endpoint only accepts its verifier
+	var codeChallenge string
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifierHash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "mock-code" || r.FormValue("client_secret") != "mock-secret" || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(wst.M{"access_token": "mock-access-token", "token_type": "Bearer"})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer mock-access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(wst.M{"sub": email, "email": email, "email_verified": true})
+	})
+	app.AddOAuthProvider("mock", &westack.OAuthProvider{
+		ClientId:         "mock-client",
+		ClientSecret:     "mock-secret",
+		Issuer:           mockServer.URL,
+		RedirectUrl:      "https://api.example.com/api/v1/users/auth/mock/callback",
+		AllowedRedirects: []string{"https://app.example.com/logged-in"},
+	})
+
+	startLogin := func(query string) *http.Response {
+		response, err := app.Server.Test(httptest.NewRequest("GET", "/api/v1/users/auth/mock"+query, nil))
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		if !assert.Equal(t, 302, response.StatusCode) {
+			return nil
+		}
+		location, err := url.Parse(response.Header.Get("Location"))
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		assert.Equal(t, mockServer.URL+"/authorize", fmt.Sprintf("%v://%v%v", location.Scheme, location.Host, location.Path))
+		assert.Equal(t, "https://api.example.com/api/v1/users/auth/mock/callback", location.Query().Get("redirect_uri"))
+		assert.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+		codeChallenge = location.Query().Get("code_challenge")
+		return response
+	}
+
+	oauthLogin := func() wst.M {
+		response := startLogin("")
+		if response == nil {
+			return nil
+		}
+		location, _ := url.Parse(response.Header.Get("Location"))
+
+		callbackRequest := httptest.NewRequest("GET", "/api/v1/users/auth/mock/callback?code=mock-code&state="+url.QueryEscape(location.Query().Get("state")), nil)
+		for _, cookie := range response.Cookies() {
+			callbackRequest.AddCookie(cookie)
+		}
+		response, err := app.Server.Test(callbackRequest)
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		var tokens wst.M
+		responseBytes, _ := io.ReadAll(response.Body)
+		_ = json.Unmarshal(responseBytes, &tokens)
+		if !assert.Equal(t, 200, response.StatusCode) {
+			return nil
+		}
+		return tokens
+	}
+
+	firstLogin := oauthLogin()
+	if firstLogin == nil || !assert.NotEmpty(t, firstLogin["id"]) {
+		return
+	}
+	// The identity is linked to the same user the next time
+	secondLogin := oauthLogin()
+	if secondLogin == nil {
+		return
+	}
+	assert.Equal(t, firstLogin["userId"], secondLogin["userId"])
+
+	// The state cannot be used without the cookie of the browser that started the login
+	response, err := app.Server.Test(httptest.NewRequest("GET", "/api/v1/users/auth/mock/callback?code=mock-code&state=invalid", nil))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 401, response.StatusCode)
+	}
+
+	// Only the allowed redirects can be chosen
+	response, err = app.Server.Test(httptest.NewRequest("GET", "/api/v1/users/auth/mock?redirect="+url.QueryEscape("https://evil.example.com"), nil))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 400, response.StatusCode)
+	}
+	response = startLogin("?redirect=" + url.QueryEscape("https://app.example.com/logged-in"))
+	if response == nil {
+		return
+	}
+	location, _ := url.Parse(response.Header.Get("Location"))
+	callbackRequest := httptest.NewRequest("GET", "/api/v1/users/auth/mock/callback?code=mock-code&state="+url.QueryEscape(location.Query().Get("state")), nil)
+	for _, cookie := range response.Cookies() {
+		callbackRequest.AddCookie(cookie)
+	}
+	response, err = app.Server.Test(callbackRequest)
+	if assert.NoError(t, err) && assert.Equal(t, 302, response.StatusCode) {
+		assert.True(t, strings.HasPrefix(response.Header.Get("Location"), "https://app.example.com/logged-in#"))
+	}
+
+}
+
+func Test_WeStackResetPassword(t *testing.T) {
+
+	email, _, _ := newSession(t)
+
+	userModel, err := app.FindModel("user")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var resetToken string
+	var resetData wst.M
+	userModel.On("sendResetPasswordEmail", func(ctx *model.EventContext) error {
+		resetData = *ctx.Data
+		resetToken = resetData["token"].(string)
+		return nil
+	})
+
+	status, _ := postJSON(t, "/api/v1/users/reset-password", wst.M{"email": email})
+	if !assert.Equal(t, 204, status) || !assert.NotEmpty(t, resetToken) {
+		return
+	}
+	// The link is built from publicUrl in config.json, not from the Host header, and sent to the stored email
+	assert.Equal(t, "http://localhost:8021/reset-password?token="+url.QueryEscape(resetToken), resetData["link"])
+	assert.Equal(t, email, resetData["email"])
+
+	status, _ = postJSON(t, "/api/v1/users/reset-password/confirm", wst.M{"token": resetToken, "password": "changed"})
+	if !assert.Equal(t, 204, status) {
+		return
+	}
+
+	// Reset tokens can only be used once
+	status, _ = postJSON(t, "/api/v1/users/reset-password/confirm", wst.M{"token": resetToken, "password": "again"})
+	assert.Equal(t, 401, status)
+
+	status, _ = postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "test"})
+	assert.Equal(t, 401, status)
+	status, _ = postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "changed"})
+	assert.Equal(t, 200, status)
+
+}
+
+func Test_WeStackChangePassword(t *testing.T) {
+
+	email, token, _ := newSession(t)
+	response, _ := invokeJSON(t, "POST", "/api/v1/users/change-password", token, wst.M{"oldPassword": "wrong", "newPassword": "changed"})
+	assert.Equal(t, 401, response.StatusCode)
+	response, _ = invokeJSON(t, "POST", "/api/v1/users/change-password", token, wst.M{"oldPassword": "test", "newPassword": "changed"})
+	assert.Equal(t, 204, response.StatusCode)
+
+	status, _ := postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "changed"})
+	assert.Equal(t, 200, status)
+
+}
+
+func Test_WeStackLoginByUsername(t *testing.T) {
+
+	n, _ := rand.Int(rand.Reader, big.NewInt(899999999))
+	email := fmt.Sprintf("email%v@example.com", 100000000+n.Int64())
+	username := fmt.Sprintf("user%v", 100000000+n.Int64())
+	createUser(t, createBody(t, wst.M{"email": email, "username": username, "password": "test"}))
+
+	status, loginResponse := postJSON(t, "/api/v1/users/login", wst.M{"username": username, "password": "test"})
+	if assert.Equal(t, 200, status) {
+		assert.NotEmpty(t, loginResponse["id"])
+	}
+
+	status, _ = postJSON(t, "/api/v1/users/login", wst.M{"password": "test"})
+	assert.Equal(t, 400, status)
+
+}
+
+func Test_WeStackUpdateIdentifierUniqueness(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	n, _ := rand.Int(rand.Reader, big.NewInt(899999999))
+	username := fmt.Sprintf("user%v", 100000000+n.Int64())
+	createUser(t, createBody(t, wst.M{"email": fmt.Sprintf("email%v@example.com", 100000000+n.Int64()), "username": username, "password": "test"}))
+
+	// The identifiers of other users cannot be taken by an update
+	response, responseBytes := invokeJSON(t, "PATCH", "/api/v1/users/"+userId, token, wst.M{"username": username})
+	assert.Equal(t, 409, response.StatusCode, string(responseBytes))
+
+	// The user's own identifiers can be written again
+	response, responseBytes = invokeJSON(t, "PATCH", "/api/v1/users/"+userId, token, wst.M{"username": username + "-own"})
+	assert.Equal(t, 200, response.StatusCode, string(responseBytes))
+	response, responseBytes = invokeJSON(t, "PATCH", "/api/v1/users/"+userId, token, wst.M{"username": username + "-own"})
+	assert.Equal(t, 200, response.StatusCode, string(responseBytes))
+
+}
+
+func Test_WeStackLoginLockout(t *testing.T) {
+
+	email, _, _ := newSession(t)
+
+	userModel, err := app.FindModel("user")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var lockedEmail string
+	userModel.On("loginLocked", func(ctx *model.EventContext) error {
+		lockedEmail = ctx.Instance.GetString("email")
+		return nil
+	})
+
+	for i := 0; i < 5; i++ {
+		status, _ := postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "wrong"})
+		assert.Equal(t, 401, status)
+	}
+	assert.Equal(t, email, lockedEmail)
+
+	// The right password is rejected too while the account is locked
+	response, _ := invokeJSON(t, "POST", "/api/v1/users/login", "", wst.M{"email": email, "password": "test"})
+	if response == nil {
+		return
+	}
+	assert.Equal(t, 429, response.StatusCode)
+	assert.NotEmpty(t, response.Header.Get("Retry-After"))
+
+}
+
+func Test_WeStackConcurrentLoginFailures(t *testing.T) {
+
+	email, _, _ := newSession(t)
+
+	userModel, err := app.FindModel("user")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var mutex sync.Mutex
+	lockouts := 0
+	userModel.On("loginLocked", func(ctx *model.EventContext) error {
+		if ctx.Instance.GetString("email") == email {
+			mutex.Lock()
+			lockouts++
+			mutex.Unlock()
+		}
+		return nil
+	})
+
+	// The failures are counted atomically, so concurrent ones lock the account once
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			invokeJSON(t, "POST", "/api/v1/users/login", "", wst.M{"email": email, "password": "wrong"})
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, lockouts)
+	status, _ := postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "test"})
+	assert.Equal(t, 429, status)
+
+}
+
+func totpNow(t *testing.T, secret string) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func Test_WeStackMfa(t *testing.T) {
+
+	email, token, _ := newSession(t)
+	setup := createJSON(t, "/api/v1/users/mfa/setup", token, wst.M{})
+	if !assert.NotEmpty(t, setup["secret"]) {
+		return
+	}
+	assert.Contains(t, setup["uri"], "otpauth://totp/")
+	verified := createJSON(t, "/api/v1/users/mfa/verify", token, wst.M{"code": totpNow(t, setup["secret"].(string))})
+	if !assert.Len(t, verified["recoveryCodes"], 10) {
+		return
+	}
+
+	status, challenge := postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "test"})
+	if !assert.Equal(t, 200, status) || !assert.Equal(t, true, challenge["mfaRequired"]) {
+		return
+	}
+	assert.Nil(t, challenge["id"])
+
+	status, _ = postJSON(t, "/api/v1/users/login/mfa", wst.M{"challengeToken": challenge["challengeToken"], "code": "000000"})
+	assert.Equal(t, 401, status)
+
+	recoveryCode := verified["recoveryCodes"].([]interface{})[0]
+	status, tokens := postJSON(t, "/api/v1/users/login/mfa", wst.M{"challengeToken": challenge["challengeToken"], "recoveryCode": recoveryCode})
+	if assert.Equal(t, 200, status) {
+		assert.NotEmpty(t, tokens["id"])
+	}
+
+	// Challenge tokens and recovery codes are valid only once
+	status, _ = postJSON(t, "/api/v1/users/login/mfa", wst.M{"challengeToken": challenge["challengeToken"], "recoveryCode": recoveryCode})
+	assert.Equal(t, 401, status)
+
+	// Also when they are used concurrently with different challenges
+	recoveryCode = verified["recoveryCodes"].([]interface{})[1]
+	var challenges []wst.M
+	for i := 0; i < 3; i++ {
+		status, challenge = postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "test"})
+		if !assert.Equal(t, 200, status) {
+			return
+		}
+		challenges = append(challenges, challenge)
+	}
+	var mutex sync.Mutex
+	accepted := 0
+	var wg sync.WaitGroup
+	for _, challenge := range challenges {
+		wg.Add(1)
+		go func(challenge wst.M) {
+			defer wg.Done()
+			status, _ := postJSON(t, "/api/v1/users/login/mfa", wst.M{"challengeToken": challenge["challengeToken"], "recoveryCode": recoveryCode})
+			if status == 200 {
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			}
+		}(challenge)
+	}
+	wg.Wait()
+	assert.Equal(t, 1, accepted)
+
+}
+
+func Test_WeStackStreamFindMany(t *testing.T) {
+
+	email, token, _ := newSession(t)
+
+	filter := url.QueryEscape(fmt.Sprintf(`{"where":{"email":%q}}`, email))
+	response, responseBytes := invokeJSON(t, "GET", "/api/v1/users?filter="+filter, token, nil, "Accept", "application/x-ndjson")
+	if !assert.Equal(t, 200, response.StatusCode) {
+		return
+	}
+	assert.Equal(t, "application/x-ndjson", response.Header.Get("Content-Type"))
+	lines := bytes.Split(bytes.TrimSpace(responseBytes), []byte("\n"))
+	if !assert.Len(t, lines, 1) {
+		return
+	}
+	var user wst.M
+	if assert.NoError(t, json.Unmarshal(lines[0], &user)) {
+		assert.Equal(t, email, user["email"])
+		assert.Nil(t, user["password"])
+	}
+
+}
+
+func Test_WeStackFilterByRelatedFields(t *testing.T) {
+
+	email, token, userId := newSession(t)
+	n, _ := rand.Int(rand.Reader, big.NewInt(899999999))
+	categoryName := fmt.Sprintf("category%v", n.Int64())
+	category := createJSON(t, "/api/v1/categories", token, wst.M{"name": categoryName, "secret": "s3cret"})
+	createJSON(t, "/api/v1/notes", token, wst.M{"title": "categorized", "userId": userId, "categoryId": category["id"]})
+	createJSON(t, "/api/v1/notes", token, wst.M{"title": "uncategorized", "userId": userId})
+
+	// category is stored in another datasource
+	status, notes := findJSON(t, "/api/v1/notes", token, wst.M{"where": wst.M{"userId": userId, "category.name": categoryName}})
+	if assert.Equal(t, 200, status) && assert.Len(t, notes, 1) {
+		assert.Equal(t, "categorized", notes[0]["title"])
+	}
+
+	// Hidden properties of the relation cannot be used
+	status, _ = findJSON(t, "/api/v1/notes", token, wst.M{"where": wst.M{"userId": userId, "category.secret": "wrong"}})
+	assert.Equal(t, 400, status)
+	status, _ = findJSON(t, "/api/v1/notes", token, wst.M{"where": wst.M{"$or": []wst.M{{"owner.password": "wrong"}, {"userId": userId}}}})
+	assert.Equal(t, 400, status)
+
+	status, notes = findJSON(t, "/api/v1/notes", token, wst.M{
+		"where":   wst.M{"owner.email": email},
+		"order":   []string{"title ASC"},
+		"include": []wst.M{{"relation": "owner"}},
+	})
+	if assert.Equal(t, 200, status) && assert.Len(t, notes, 2) {
+		owner, _ := notes[0]["owner"].(map[string]interface{})
+		assert.Equal(t, email, owner["email"])
+		assert.Nil(t, owner["password"])
+	}
+
+	// The relation joined for the where clause is reused by the include
+	noteModel, err := app.FindModel("note")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lookups := noteModel.ExtractLookupsFromFilter(&wst.Filter{
+		Where:   &wst.Where{"owner.email": email},
+		Include: &wst.Include{{Relation: "owner"}},
+	}, false)
+	lookupCount := 0
+	for _, stage := range *lookups {
+		if stage["$lookup"] != nil {
+			lookupCount++
+		}
+	}
+	assert.Equal(t, 1, lookupCount)
+
+}
+
+func Test_WeStackIncludeScopeLimit(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	n, _ := rand.Int(rand.Reader, big.NewInt(899999999))
+	var names []string
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("category%v-%v", n.Int64(), i)
+		names = append(names, name)
+		category := createJSON(t, "/api/v1/categories", token, wst.M{"name": name})
+		for _, title := range []string{"a", "b", "c"} {
+			createJSON(t, "/api/v1/notes", token, wst.M{"title": title, "userId": userId, "categoryId": category["id"]})
+		}
+	}
+
+	// notes are stored in another datasource, the limit applies to every category
+	status, categories := findJSON(t, "/api/v1/categories", token, wst.M{
+		"where":   wst.M{"name": wst.M{"$in": names}},
+		"include": []wst.M{{"relation": "notes", "scope": wst.M{"order": []string{"title ASC"}, "skip": 1, "limit": 1}}},
+	})
+	if assert.Equal(t, 200, status) && assert.Len(t, categories, 2) {
+		for _, category := range categories {
+			notes, _ := category["notes"].([]interface{})
+			if assert.Len(t, notes, 1) {
+				assert.Equal(t, "b", notes[0].(map[string]interface{})["title"])
+			}
+		}
+	}
+
+}
+
+func Test_WeStackRecursiveInclude(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	root := createJSON(t, "/api/v1/notes", token, wst.M{"title": "root", "userId": userId})
+	child := createJSON(t, "/api/v1/notes", token, wst.M{"title": "child", "userId": userId, "parentId": root["id"]})
+	createJSON(t, "/api/v1/notes", token, wst.M{"title": "grandchild", "userId": userId, "parentId": child["id"]})
+
+	status, notes := findJSON(t, "/api/v1/notes", token, wst.M{
+		"where":   wst.M{"_id": root["id"]},
+		"include": []wst.M{{"relation": "children", "recursive": true}},
+	})
+	if !assert.Equal(t, 200, status) || !assert.Len(t, notes, 1) {
+		return
+	}
+	children, _ := notes[0]["children"].([]interface{})
+	if !assert.Len(t, children, 1) {
+		return
+	}
+	assert.Equal(t, "child", children[0].(map[string]interface{})["title"])
+	grandchildren, _ := children[0].(map[string]interface{})["children"].([]interface{})
+	if assert.Len(t, grandchildren, 1) {
+		assert.Equal(t, "grandchild", grandchildren[0].(map[string]interface{})["title"])
+	}
+
+	status, _ = findJSON(t, "/api/v1/notes", token, wst.M{
+		"where":   wst.M{"_id": root["id"]},
+		"include": []wst.M{{"relation": "children", "recursive": true, "scope": wst.M{"order": []string{"title ASC"}}}},
+	})
+	assert.Equal(t, 400, status)
+
+}
+
+func Test_WeStackAggregate(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	createJSON(t, "/api/v1/notes", token, wst.M{"title": "a", "tag": "work", "views": 1, "userId": userId})
+	createJSON(t, "/api/v1/notes", token, wst.M{"title": "b", "tag": "work", "views": 2, "userId": userId})
+	createJSON(t, "/api/v1/notes", token, wst.M{"title": "c", "tag": "home", "views": 5, "userId": userId})
+
+	where := url.QueryEscape(fmt.Sprintf(`{"userId":%q}`, userId))
+	response, responseBytes := invokeJSON(t, "GET", "/api/v1/notes/aggregate?where="+where+"&groupBy=tag&metrics=count,sum:views,max:views", token, nil)
+	if !assert.Equal(t, 200, response.StatusCode, string(responseBytes)) {
+		return
+	}
+	var groups []wst.M
+	if !assert.NoError(t, json.Unmarshal(responseBytes, &groups)) || !assert.Len(t, groups, 2) {
+		return
+	}
+	assert.Equal(t, wst.M{"tag": "home", "count": 1.0, "sum_views": 5.0, "max_views": 5.0}, groups[0])
+	assert.Equal(t, wst.M{"tag": "work", "count": 2.0, "sum_views": 3.0, "max_views": 2.0}, groups[1])
+
+	// Hidden properties cannot be aggregated
+	response, _ = invokeJSON(t, "GET", "/api/v1/users/aggregate?groupBy=password", token, nil)
+	assert.Equal(t, 400, response.StatusCode)
+
+	response, _ = invokeJSON(t, "GET", "/api/v1/notes/aggregate?metrics=median:views", token, nil)
+	assert.Equal(t, 400, response.StatusCode)
+
+}
+
+func Test_WeStackSearch(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	keyword := "kw" + userId
+	matching := createJSON(t, "/api/v1/notes", token, wst.M{"title": "a", "body": "remember the " + keyword, "userId": userId})
+	createJSON(t, "/api/v1/notes", token, wst.M{"title": "b", "body": "nothing to see here", "userId": userId})
+
+	filter := url.QueryEscape(fmt.Sprintf(`{"where":{"userId":%q}}`, userId))
+	response, responseBytes := invokeJSON(t, "GET", "/api/v1/notes/search?q="+keyword+"&filter="+filter, token, nil)
+	if !assert.Equal(t, 200, response.StatusCode, string(responseBytes)) {
+		return
+	}
+	var found []wst.M
+	if !assert.NoError(t, json.Unmarshal(responseBytes, &found)) || !assert.Len(t, found, 1) {
+		return
+	}
+	assert.Equal(t, matching["id"], found[0]["id"])
+
+	response, _ = invokeJSON(t, "GET", "/api/v1/notes/search?q=%20", token, nil)
+	assert.Equal(t, 400, response.StatusCode)
+
+}
+
+func Test_WeStackGeoQueries(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	sol := createJSON(t, "/api/v1/notes", token, wst.M{"title": "sol", "location": wst.M{"lat": 40.4168, "lng": -3.7038}, "userId": userId})
+	retiro := createJSON(t, "/api/v1/notes", token, wst.M{"title": "retiro", "location": []float64{-3.6844, 40.4153}, "userId": userId})
+	barcelona := createJSON(t, "/api/v1/notes", token, wst.M{"title": "barcelona", "location": wst.M{"lat": 41.3874, "lng": 2.1686}, "userId": userId})
+
+	status, found := findJSON(t, "/api/v1/notes", token, wst.M{"where": wst.M{
+		"userId":   userId,
+		"location": wst.M{"near": wst.M{"lat": 40.4169, "lng": -3.7035}, "maxDistance": 5000},
+	}})
+	if assert.Equal(t, 200, status) && assert.Len(t, found, 2) {
+		assert.Equal(t, sol["id"], found[0]["id"])
+		assert.Equal(t, retiro["id"], found[1]["id"])
+		assert.Less(t, found[0]["_distance"], found[1]["_distance"])
+	}
+
+	status, found = findJSON(t, "/api/v1/notes", token, wst.M{"where": wst.M{
+		"userId":   userId,
+		"location": wst.M{"within": wst.M{"box": [][]float64{{2.0, 41.3}, {2.3, 41.5}}}},
+	}})
+	if assert.Equal(t, 200, status) && assert.Len(t, found, 1) {
+		assert.Equal(t, barcelona["id"], found[0]["id"])
+	}
+
+	response, _ := invokeJSON(t, "POST", "/api/v1/notes", token, wst.M{"title": "invalid", "location": wst.M{"lat": 100, "lng": 0}, "userId": userId})
+	assert.Equal(t, 400, response.StatusCode)
+
+}
+
+func Test_WeStackScopes(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	createJSON(t, "/api/v1/tasks", token, wst.M{"title": "low", "priority": 1, "userId": userId})
+	high := createJSON(t, "/api/v1/tasks", token, wst.M{"title": "high", "priority": 5, "userId": userId})
+	medium := createJSON(t, "/api/v1/tasks", token, wst.M{"title": "medium", "priority": 3, "userId": userId})
+	archived := createJSON(t, "/api/v1/tasks", token, wst.M{"title": "archived", "priority": 4, "archived": true, "userId": userId})
+
+	status, found := findJSON(t, "/api/v1/tasks/scopes/urgent", token, wst.M{"where": wst.M{"userId": userId}})
+	if assert.Equal(t, 200, status) && assert.Len(t, found, 2) {
+		assert.Equal(t, high["id"], found[0]["id"])
+		assert.Equal(t, medium["id"], found[1]["id"])
+	}
+
+	// The order of the request replaces the one of the scope
+	status, found = findJSON(t, "/api/v1/tasks/scopes/urgent", token, wst.M{"where": wst.M{"userId": userId}, "order": []string{"priority ASC"}})
+	if assert.Equal(t, 200, status) && assert.Len(t, found, 2) {
+		assert.Equal(t, medium["id"], found[0]["id"])
+	}
+
+	// The default scope applies to every query
+	status, found = findJSON(t, "/api/v1/tasks", token, wst.M{"where": wst.M{"userId": userId}})
+	if assert.Equal(t, 200, status) {
+		assert.Len(t, found, 3)
+	}
+	response, _ := invokeJSON(t, "GET", fmt.Sprintf("/api/v1/tasks/%v", archived["id"]), token, nil)
+	assert.Equal(t, 404, response.StatusCode)
+
+	// Except for system bearers
+	taskModel, err := app.FindModel("task")
+	if assert.NoError(t, err) {
+		instances, err := taskModel.FindMany(&wst.Filter{Where: &wst.Where{"userId": userId}}, &model.EventContext{
+			Bearer: &model.BearerToken{User: &model.BearerUser{System: true}},
+		})
+		if assert.NoError(t, err) {
+			assert.Len(t, instances, 4)
+		}
+	}
+
+}
+
+func Test_WeStackSoftDelete(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	task := createJSON(t, "/api/v1/tasks", token, wst.M{"title": "to restore", "priority": 1, "userId": userId})
+	taskId, _ := task["id"].(string)
+
+	taskModel, err := app.FindModel("task")
+	if !assert.NoError(t, err) {
+		return
+	}
+	hookCalls := map[string]int{}
+	for _, operation := range []string{"before delete", "after delete", "before restore", "after restore"} {
+		operation := operation
+		taskModel.Observe(operation, func(ctx *model.EventContext) error {
+			hookCalls[operation+" "+model.GetIDAsString(ctx.ModelID)]++
+			return nil
+		})
+	}
+
+	response, _ := invokeJSON(t, "DELETE", "/api/v1/tasks/"+taskId, token, nil)
+	assert.Equal(t, 204, response.StatusCode)
+	response, _ = invokeJSON(t, "GET", "/api/v1/tasks/"+taskId, token, nil)
+	assert.Equal(t, 404, response.StatusCode)
+	status, found := findJSON(t, "/api/v1/tasks", token, wst.M{"where": wst.M{"userId": userId}})
+	if assert.Equal(t, 200, status) {
+		assert.Len(t, found, 0)
+	}
+
+	response, responseBytes := invokeJSON(t, "POST", "/api/v1/tasks/"+taskId+"/restore", token, nil)
+	if assert.Equal(t, 200, response.StatusCode, string(responseBytes)) {
+		var restored wst.M
+		_ = json.Unmarshal(responseBytes, &restored)
+		assert.Equal(t, "to restore", restored["title"])
+	}
+	response, _ = invokeJSON(t, "GET", "/api/v1/tasks/"+taskId, token, nil)
+	assert.Equal(t, 200, response.StatusCode)
+	response, _ = invokeJSON(t, "POST", "/api/v1/tasks/"+taskId+"/restore", token, nil)
+	assert.Equal(t, 404, response.StatusCode)
+
+	// instance_purge is not part of write
+	response, _ = invokeJSON(t, "DELETE", "/api/v1/tasks/"+taskId+"/purge", token, nil)
+	assert.Equal(t, 401, response.StatusCode)
+
+	// Purge applies the onDelete option of the relations
+	note := createJSON(t, "/api/v1/notes", token, wst.M{"title": "cascaded", "taskId": taskId, "userId": userId})
+	deletedCount, err := taskModel.Purge(taskId, &model.EventContext{
+		Bearer: &model.BearerToken{User: &model.BearerUser{System: true}},
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), deletedCount)
+	}
+	response, _ = invokeJSON(t, "GET", fmt.Sprintf("/api/v1/notes/%v", note["id"]), token, nil)
+	assert.Equal(t, 404, response.StatusCode)
+
+	// Delete and purge run the delete hooks, restore runs its own. before restore runs for the failed restore too
+	assert.Equal(t, 2, hookCalls["before delete "+taskId])
+	assert.Equal(t, 2, hookCalls["after delete "+taskId])
+	assert.Equal(t, 2, hookCalls["before restore "+taskId])
+	assert.Equal(t, 1, hookCalls["after restore "+taskId])
+
+}
+
+func Test_WeStackVersioning(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	task := createJSON(t, "/api/v1/tasks", token, wst.M{"title": "v1", "userId": userId})
+	taskId, _ := task["id"].(string)
+	assert.Equal(t, 1.0, task["_version"])
+
+	response, _ := invokeJSON(t, "GET", "/api/v1/tasks/"+taskId, token, nil)
+	assert.Equal(t, `"1"`, response.Header.Get("ETag"))
+
+	// An update without changes does not increment the version
+	response, responseBytes := invokeJSON(t, "PATCH", "/api/v1/tasks/"+taskId, token, wst.M{"title": "v1"})
+	if assert.Equal(t, 200, response.StatusCode, string(responseBytes)) {
+		var updated wst.M
+		_ = json.Unmarshal(responseBytes, &updated)
+		assert.Equal(t, 1.0, updated["_version"])
+	}
+
+	response, responseBytes = invokeJSON(t, "PATCH", "/api/v1/tasks/"+taskId, token, wst.M{"title": "v2"}, "If-Match", `"1"`)
+	if assert.Equal(t, 200, response.StatusCode, string(responseBytes)) {
+		var updated wst.M
+		_ = json.Unmarshal(responseBytes, &updated)
+		assert.Equal(t, 2.0, updated["_version"])
+	}
+
+	// Stale versions are rejected
+	response, _ = invokeJSON(t, "PATCH", "/api/v1/tasks/"+taskId, token, wst.M{"title": "v3", "_version": 1})
+	assert.Equal(t, 409, response.StatusCode)
+
+}
+
+func Test_WeStackAuditHistory(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	task := createJSON(t, "/api/v1/tasks", token, wst.M{"title": "before", "userId": userId})
+	taskId, _ := task["id"].(string)
+
+	response, _ := invokeJSON(t, "PATCH", "/api/v1/tasks/"+taskId, token, wst.M{"title": "after"}, "X-Request-Id", "request-"+taskId)
+	assert.Equal(t, 200, response.StatusCode)
+	// An update without changes is not recorded
+	response, _ = invokeJSON(t, "PATCH", "/api/v1/tasks/"+taskId, token, wst.M{"title": "after"})
+	assert.Equal(t, 200, response.StatusCode)
+	response, _ = invokeJSON(t, "DELETE", "/api/v1/tasks/"+taskId, token, nil)
+	assert.Equal(t, 204, response.StatusCode)
+	response, _ = invokeJSON(t, "POST", "/api/v1/tasks/"+taskId+"/restore", token, nil)
+	assert.Equal(t, 200, response.StatusCode)
+
+	response, responseBytes := invokeJSON(t, "GET", "/api/v1/tasks/"+taskId+"/history", token, nil)
+	if !assert.Equal(t, 200, response.StatusCode, string(responseBytes)) {
+		return
+	}
+	var records []wst.M
+	if !assert.NoError(t, json.Unmarshal(responseBytes, &records)) || !assert.Len(t, records, 4) {
+		return
+	}
+	byAction := map[string]wst.M{}
+	for _, record := range records {
+		action, _ := record["action"].(string)
+		byAction[action] = record
+		assert.Equal(t, "task", record["model"])
+		assert.Equal(t, userId, record["userId"])
+	}
+	for _, action := range []string{"create", "update", "delete", "restore"} {
+		assert.Contains(t, byAction, action)
+	}
+	update := byAction["update"]
+	assert.Equal(t, "request-"+taskId, update["requestId"])
+	diff, _ := update["diff"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"from": "before", "to": "after"}, diff["title"])
+
+}
+
+func Test_WeStackDirtyTracking(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	note := createJSON(t, "/api/v1/notes", token, wst.M{"title": "tracked", "tag": "old", "views": 1, "userId": userId})
+	noteId, _ := note["id"].(string)
+
+	noteModel, err := app.FindModel("note")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var changes, previousValues wst.M
+	noteModel.Observe("before save", func(ctx *model.EventContext) error {
+		if !ctx.IsNewInstance && model.GetIDAsString(ctx.ModelID) == noteId {
+			changes = ctx.Changes()
+			previousValues = *ctx.PreviousValues
+		}
+		return nil
+	})
+
+	response, responseBytes := invokeJSON(t, "PATCH", "/api/v1/notes/"+noteId, token, wst.M{"title": "tracked", "tag": "new"})
+	if !assert.Equal(t, 200, response.StatusCode, string(responseBytes)) {
+		return
+	}
+	assert.Equal(t, "new", changes["tag"])
+	assert.NotContains(t, changes, "title")
+	assert.Equal(t, "old", previousValues["tag"])
+
+	// Only the changed properties are written, so concurrent updates to other properties are kept
+	systemContext := &model.EventContext{Bearer: &model.BearerToken{User: &model.BearerUser{System: true}}}
+	instance, err := noteModel.FindById(noteId, nil, systemContext)
+	if !assert.NoError(t, err) {
+		return
+	}
+	response, _ = invokeJSON(t, "PATCH", "/api/v1/notes/"+noteId, token, wst.M{"views": 5})
+	assert.Equal(t, 200, response.StatusCode)
+	_, err = instance.UpdateAttributes(wst.M{"views": 1.0, "tag": "newer"}, systemContext)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, changes, "views")
+
+	response, responseBytes = invokeJSON(t, "GET", "/api/v1/notes/"+noteId, token, nil)
+	if assert.Equal(t, 200, response.StatusCode) {
+		var stored wst.M
+		_ = json.Unmarshal(responseBytes, &stored)
+		assert.Equal(t, 5.0, stored["views"])
+		assert.Equal(t, "newer", stored["tag"])
+	}
+
+}
+
+func Test_WeStackUpdateOperators(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	task := createJSON(t, "/api/v1/tasks", token, wst.M{"title": "counted", "views": 0, "likes": 0, "userId": userId})
+	taskId, _ := task["id"].(string)
+
+	response, responseBytes := invokeJSON(t, "PATCH", "/api/v1/tasks/"+taskId, token, wst.M{"$inc": wst.M{"views": 2}})
+	if assert.Equal(t, 200, response.StatusCode, string(responseBytes)) {
+		var updated wst.M
+		_ = json.Unmarshal(responseBytes, &updated)
+		assert.Equal(t, 2.0, updated["views"])
+	}
+
+	// Operators not declared by the property
+	response, _ = invokeJSON(t, "PATCH", "/api/v1/tasks/"+taskId, token, wst.M{"$inc": wst.M{"priority": 1}})
+	assert.Equal(t, 400, response.StatusCode)
+	response, _ = invokeJSON(t, "PATCH", "/api/v1/tasks/"+taskId, token, wst.M{"$set": wst.M{"views": 100}})
+	assert.Equal(t, 400, response.StatusCode)
+
+	// __inc__likes has no policy
+	response, _ = invokeJSON(t, "PATCH", "/api/v1/tasks/"+taskId, token, wst.M{"$inc": wst.M{"likes": 1}})
+	assert.Equal(t, 401, response.StatusCode)
+
+	taskModel, err := app.FindModel("task")
+	if !assert.NoError(t, err) {
+		return
+	}
+	userContext := &model.EventContext{Bearer: &model.BearerToken{User: &model.BearerUser{Id: userId}}}
+	instance, err := taskModel.FindById(taskId, nil, userContext)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Go calls are checked too when made on behalf of a user
+	_, err = instance.UpdateAttributes(wst.M{"$inc": wst.M{"likes": 1}}, userContext)
+	assert.Error(t, err)
+
+	systemContext := &model.EventContext{Bearer: &model.BearerToken{User: &model.BearerUser{System: true}}}
+	updated, err := instance.UpdateAttributes(wst.M{"$inc": wst.M{"likes": 1}}, systemContext)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1.0, updated.ToJSON()["likes"])
+	}
+
+}
+
+func Test_WeStackTransaction(t *testing.T) {
+
+	_, _, userId := newSession(t)
+	noteModel, err := app.FindModel("note")
+	if !assert.NoError(t, err) {
+		return
+	}
+	categoryModel, err := app.FindModel("category")
+	if !assert.NoError(t, err) {
+		return
+	}
+	systemContext := &model.EventContext{Bearer: &model.BearerToken{User: &model.BearerUser{System: true}}}
+	countNotes := func(title string) int {
+		found, err := noteModel.FindMany(&wst.Filter{Where: &wst.Where{"userId": userId, "title": title}}, systemContext)
+		assert.NoError(t, err)
+		return len(found)
+	}
+
+	err = app.Transaction(func(tx *model.EventContext) error {
+		_, err := noteModel.Create(wst.M{"title": "aborted", "userId": userId}, tx)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("rollback")
+	})
+	if err != nil && strings.Contains(err.Error(), "replica set") {
+		t.Skip("MongoDB transactions require a replica set")
+	}
+	assert.EqualError(t, err, "rollback")
+	assert.Equal(t, 0, countNotes("aborted"))
+
+	// Both datasources are committed together
+	var categoryId interface{}
+	err = app.Transaction(func(tx *model.EventContext) error {
+		category, err := categoryModel.Create(wst.M{"name": "committed " + userId}, tx)
+		if err != nil {
+			return err
+		}
+		categoryId = category.Id
+		_, err = noteModel.Create(wst.M{"title": "committed", "userId": userId, "categoryId": category.Id}, tx)
+		return err
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, countNotes("committed"))
+		_, err = categoryModel.FindById(categoryId, nil, systemContext)
+		assert.NoError(t, err)
+	}
+
+	assert.Panics(t, func() {
+		_ = app.Transaction(func(tx *model.EventContext) error {
+			_, err := noteModel.Create(wst.M{"title": "panicked", "userId": userId}, tx)
+			if err != nil {
+				return err
+			}
+			panic("unexpected")
+		})
+	})
+	assert.Equal(t, 0, countNotes("panicked"))
+
+}
+
+func Test_WeStackCascadeTransaction(t *testing.T) {
+
+	_, token, userId := newSession(t)
+	noteModel, err := app.FindModel("note")
+	if !assert.NoError(t, err) {
+		return
+	}
+	categoryModel, err := app.FindModel("category")
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !noteModel.Datasource.SupportsTransactions() || !categoryModel.Datasource.SupportsTransactions() {
+		t.Skip("MongoDB transactions require a replica set")
+	}
+	category := createJSON(t, "/api/v1/categories", token, wst.M{"name": "cascaded " + userId})
+	note := createJSON(t, "/api/v1/notes", token, wst.M{"title": "anonymized", "userId": userId, "categoryId": category["id"]})
+	categoryId, _ := category["id"].(string)
+
+	// The delete fails after the notes were anonymized
+	categoryModel.Observe("after delete", func(ctx *model.EventContext) error {
+		if model.GetIDAsString(ctx.ModelID) == categoryId {
+			return fmt.Errorf("cascade failed")
+		}
+		return nil
+	})
+	_, err = categoryModel.DeleteById(categoryId, &model.EventContext{
+		Bearer: &model.BearerToken{User: &model.BearerUser{System: true}},
+	})
+	assert.EqualError(t, err, "cascade failed")
+
+	// Nothing was applied, the note keeps its category
+	response, responseBytes := invokeJSON(t, "GET", fmt.Sprintf("/api/v1/notes/%v", note["id"]), token, nil)
+	if assert.Equal(t, 200, response.StatusCode) {
+		var found wst.M
+		_ = json.Unmarshal(responseBytes, &found)
+		assert.Equal(t, categoryId, found["categoryId"])
+	}
+	response, _ = invokeJSON(t, "GET", "/api/v1/categories/"+categoryId, token, nil)
+	assert.Equal(t, 200, response.StatusCode)
+
+}
+
+type typedTask struct {
+	Id       primitive.ObjectID `bson:"id,omitempty"`
+	Title    string             `bson:"title"`
+	Priority float64            `bson:"priority,omitempty"`
+	Version  int64              `bson:"_version"`
+	Created  time.Time          `bson:"created,omitempty"`
+}
+
+func Test_WeStackTypedModel(t *testing.T) {
+
+	_, _, userId := newSession(t)
+	taskModel, err := app.FindModel("task")
+	if !assert.NoError(t, err) {
+		return
+	}
+	tasks := model.Typed[typedTask](taskModel)
+	systemContext := &model.EventContext{Bearer: &model.BearerToken{User: &model.BearerUser{System: true}}}
+	title := "typed " + userId
+
+	created, err := tasks.Create(typedTask{Title: title, Priority: 2}, systemContext)
+	if !assert.NoError(t, err) || !assert.NotNil(t, created) {
+		return
+	}
+	assert.False(t, created.Id.IsZero())
+	assert.Equal(t, int64(1), created.Version)
+	// Set by the before save hook
+	assert.False(t, created.Created.IsZero())
+
+	found, err := tasks.FindMany(&wst.Filter{Where: &wst.Where{"title": title}}, systemContext)
+	if assert.NoError(t, err) && assert.Len(t, found, 1) {
+		assert.Equal(t, created.Id, found[0].Id)
+		assert.Equal(t, 2.0, found[0].Priority)
+	}
+
+	updated, err := tasks.Update(created.Id, wst.M{"priority": 4.0}, systemContext)
+	if assert.NoError(t, err) && assert.NotNil(t, updated) {
+		assert.Equal(t, 4.0, updated.Priority)
+		assert.Equal(t, title, updated.Title)
+		assert.Equal(t, int64(2), updated.Version)
+	}
+	updated, err = tasks.Update(created.Id, typedTask{Title: title + " renamed", Version: 2}, systemContext)
+	if assert.NoError(t, err) && assert.NotNil(t, updated) {
+		assert.Equal(t, title+" renamed", updated.Title)
+		assert.Equal(t, 4.0, updated.Priority)
+	}
+
+	// Permission checks are kept
+	_, err = tasks.Update(created.Id, wst.M{"$inc": wst.M{"likes": 1}}, &model.EventContext{Bearer: &model.BearerToken{User: &model.BearerUser{Id: userId}}})
+	assert.Error(t, err)
+
+	deletedCount, err := tasks.Delete(created.Id, systemContext)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), deletedCount)
+	}
+	deleted, err := tasks.FindById(created.Id, nil, systemContext)
+	assert.NoError(t, err)
+	assert.Nil(t, deleted)
+
+}
+
+func Test_WeStackVerifyMailRejectsAccessTokens(t *testing.T) {
+
+	_, token, _ := newSession(t)
+	response, _ := invokeJSON(t, "GET", "/api/v1/users/verify-mail?token="+url.QueryEscape(token), "", nil)
+	assert.Equal(t, 401, response.StatusCode)
+	response, _ = invokeJSON(t, "GET", "/api/v1/users/verify-mail?token=invalid", "", nil)
+	assert.Equal(t, 401, response.StatusCode)
+
+}
+
+func Test_WeStackLogoutAndSessions(t *testing.T) {
+
+	_, token, userId := newSession(t)
+
+	// Only administrators can list sessions, not the owner
+	response, _ := invokeJSON(t, "GET", "/api/v1/users/"+userId+"/sessions", token, nil)
+	assert.Equal(t, 401, response.StatusCode)
+	response, _ = invokeJSON(t, "DELETE", "/api/v1/users/"+userId+"/sessions/any", token, nil)
+	assert.Equal(t, 401, response.StatusCode)
+
+	// Without jwt.persistTokens the access token is not revoked, and the response says so
+	response, responseBytes := invokeJSON(t, "POST", "/api/v1/users/logout", token, nil)
+	if assert.Equal(t, 200, response.StatusCode, string(responseBytes)) {
+		var result wst.M
+		_ = json.Unmarshal(responseBytes, &result)
+		assert.Equal(t, false, result["accessTokenRevoked"])
+		assert.NotEmpty(t, result["message"])
+	}
+
+}
+
+// findMail returns the last .eml written by the file transport of the mail datasource to the given address
+func findMail(t *testing.T, to string) string {
+	entries, err := os.ReadDir("./data/mails")
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	found := ""
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join("./data/mails", entry.Name()))
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		if strings.Contains(string(content), "To: "+to+"\r\n") {
+			found = string(content)
+		}
+	}
+	return found
+}
+
+func Test_WeStackMailDatasource(t *testing.T) {
+
+	ds, err := app.FindDatasource("mail")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	n, _ := rand.Int(rand.Reader, big.NewInt(899999999))
+	to := fmt.Sprintf("email%v@example.com", 100000000+n.Int64())
+	err = ds.SendMail(datasource.Mail{To: []string{to}, Subject: "Hello", Text: "plain", Html: "<p>html</p>"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	content := findMail(t, to)
+	assert.Contains(t, content, "From: no-reply@example.com\r\n")
+	assert.Contains(t, content, "Subject: Hello\r\n")
+	assert.Contains(t, content, "multipart/alternative")
+
+	// Header injection through the recipients is rejected
+	err = ds.SendMail(datasource.Mail{To: []string{to + "\r\nBcc: other@example.com"}, Text: "plain"})
+	assert.Error(t, err)
+
+	// The log transport does not print the links, they usually carry tokens
+	logDs, err := app.FindDatasource("mailLog")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	err = logDs.SendMail(datasource.Mail{To: []string{to}, Html: `<a href="https://app.example.com/verify?token=secret-token">verify</a>`})
+	log.SetOutput(os.Stderr)
+	if assert.NoError(t, err) {
+		assert.NotContains(t, output.String(), "secret-token")
+		assert.Contains(t, output.String(), "[redacted link]")
+	}
+
+}
+
+func Test_WeStackVerifyMail(t *testing.T) {
+
+	email, token, userId := newSession(t)
+	response, responseBytes := invokeJSON(t, "POST", "/api/v1/users/verify-mail", token, nil)
+	if !assert.Equal(t, 204, response.StatusCode, string(responseBytes)) {
+		return
+	}
+
+	// The link is built from publicUrl, and the token only verifies the email
+	content := findMail(t, email)
+	match := regexp.MustCompile(`http://localhost:8021/api/v1/users/verify-mail\?token=([^"&<\s]+)`).FindStringSubmatch(content)
+	if !assert.NotNil(t, match, content) {
+		return
+	}
+	verificationToken, err := url.QueryUnescape(match[1])
+	if !assert.NoError(t, err) {
+		return
+	}
+	response, _ = invokeJSON(t, "GET", "/api/v1/users/"+userId, verificationToken, nil)
+	assert.Equal(t, 401, response.StatusCode)
+
+	response, responseBytes = invokeJSON(t, "GET", "/api/v1/users/verify-mail?token="+url.QueryEscape(verificationToken), "", nil)
+	if !assert.Equal(t, 204, response.StatusCode, string(responseBytes)) {
+		return
+	}
+	response, responseBytes = invokeJSON(t, "GET", "/api/v1/users/"+userId, token, nil)
+	if assert.Equal(t, 200, response.StatusCode) {
+		var user wst.M
+		_ = json.Unmarshal(responseBytes, &user)
+		assert.Equal(t, true, user["emailVerified"])
+	}
+
+}
+
+func Test_WeStackProtectedUserFields(t *testing.T) {
+
+	email, token, userId := newSession(t)
+	for _, body := range []wst.M{
+		{"email": "other" + email},
+		{"emailVerified": true},
+		{"password": "changed"},
+		{"$set": wst.M{"emailVerified": true}},
+		{"$rename": wst.M{"username": "password"}},
+	} {
+		response, responseBytes := invokeJSON(t, "PATCH", "/api/v1/users/"+userId, token, body)
+		assert.Equal(t, 400, response.StatusCode, string(responseBytes))
+	}
+
+	// Nothing changed
+	status, _ := postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "test"})
+	assert.Equal(t, 200, status)
+	response, responseBytes := invokeJSON(t, "GET", "/api/v1/users/"+userId, token, nil)
+	if assert.Equal(t, 200, response.StatusCode) {
+		var user wst.M
+		_ = json.Unmarshal(responseBytes, &user)
+		assert.NotEqual(t, true, user["emailVerified"])
+	}
+
+}
+
+func Test_WeStackMfaFieldProtection(t *testing.T) {
+
+	email, token, userId := newSession(t)
+	for _, body := range []wst.M{
+		{"mfa": wst.M{"enabled": true, "secret": "JBSWY3DPEHPK3PXP"}},
+		{"mfa.enabled": true},
+		{"mfa.secret": "JBSWY3DPEHPK3PXP"},
+		{"$set": wst.M{"mfa.enabled": true}},
+		{"$unset": wst.M{"mfa.secret": ""}},
+		{"$rename": wst.M{"username": "mfa.secret"}},
+	} {
+		response, responseBytes := invokeJSON(t, "PATCH", "/api/v1/users/"+userId, token, body)
+		assert.Equal(t, 400, response.StatusCode, string(responseBytes))
+	}
+
+	// MFA is still disabled, the login returns the tokens instead of a challenge
+	status, loginResponse := postJSON(t, "/api/v1/users/login", wst.M{"email": email, "password": "test"})
+	if assert.Equal(t, 200, status) {
+		assert.NotEmpty(t, loginResponse["id"])
+	}
+
+}
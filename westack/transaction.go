@@ -0,0 +1,43 @@
+package westack
+
+import (
+	"log"
+
+	"github.com/fredyk/westack-go/westack/model"
+)
+
+/*
+Transaction runs handler inside a transaction. Pass tx as the context of every operation that must be part of it:
+
+	err := app.Transaction(func(tx *model.EventContext) error {
+		order, err := orderModel.Create(wst.M{"total": 10}, tx)
+		if err != nil {
+			return err
+		}
+		_, err = orderItemModel.Create(wst.M{"orderId": order.Id}, tx)
+		return err
+	})
+
+The transaction is committed if handler returns nil, and aborted if it returns an error or panics. Operations on
+datasources that do not support transactions, like redis, fail with an error.
+*/
+func (app *WeStack) Transaction(handler func(tx *model.EventContext) error) (err error) {
+	transaction := model.NewTransaction()
+	defer func() {
+		if r := recover(); r != nil {
+			if abortErr := transaction.Abort(); abortErr != nil {
+				log.Println("ERROR: Could not abort transaction:", abortErr)
+			}
+			panic(r)
+		}
+	}()
+
+	err = handler(&model.EventContext{Transaction: transaction})
+	if err != nil {
+		if abortErr := transaction.Abort(); abortErr != nil {
+			log.Println("ERROR: Could not abort transaction:", abortErr)
+		}
+		return err
+	}
+	return transaction.Commit()
+}
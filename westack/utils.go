@@ -120,3 +120,15 @@ func replaceVarNames(definition string) string {
 		return "_" + strings.ToUpper(match[1:]) + "_"
 	})
 }
+
+// splitQueryList splits a comma separated query parameter, ignoring empty items
+func splitQueryList(value string) []string {
+	result := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
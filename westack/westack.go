@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"os"
 	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -35,10 +38,17 @@ type WeStack struct {
 	debug             bool
 	restApiRoot       string
 	roleMappingModel  *model.Model
+	accessTokenModel  *model.Model
+	userIdentityModel *model.Model
 	dataSourceOptions *map[string]*datasource.Options
 	_swaggerPaths     map[string]wst.M
 	init              time.Time
 	jwtSecretKey      []byte
+	jwtKeys           *jwtKeySet
+	oauthProviders    map[string]*OAuthProvider
+	oauthMutex        sync.RWMutex
+	mailTemplates     map[string]*template.Template
+	loginProtection   *loginProtection
 	viper             *viper.Viper
 }
 
@@ -60,10 +70,26 @@ func (app *WeStack) FindDatasource(dsName string) (*datasource.Datasource, error
 	return result, nil
 }
 
+// publicUrl returns publicUrl in config.json, the url where clients reach the app, like https://api.example.com. Links
+// sent by email are built from it, never from the Host header of the request
+func (app *WeStack) publicUrl() string {
+	publicUrl := app.viper.GetString("publicUrl")
+	if publicUrl != "" && !isAbsoluteUrl(publicUrl) {
+		panic(fmt.Sprintf("invalid publicUrl %v", publicUrl))
+	}
+	return strings.TrimSuffix(publicUrl, "/")
+}
+
 func (app *WeStack) Boot(customRoutesCallbacks ...func(app *WeStack)) {
 
+	app.loadJwtKeys()
+	app.loadOAuthProviders()
+
 	app.loadDataSources()
 
+	app.loadMailTemplates()
+	app.loadLoginProtection()
+
 	app.loadModels()
 
 	app.Middleware(func(c *fiber.Ctx) error {
@@ -103,6 +129,8 @@ func (app *WeStack) Boot(customRoutesCallbacks ...func(app *WeStack)) {
 	app.loadModelsDynamicRoutes()
 	app.loadNotFoundRoutes()
 
+	app.Server.Get("/.well-known/jwks.json", jwksHandler(app))
+
 	app.Server.Get("/swagger/doc.json", swaggerDocsHandler(app))
 
 	app.Server.Get("/swagger/*", func(ctx *fiber.Ctx) error {